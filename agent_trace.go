@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// TraceStep is a model call, or a tool call made by one, in an agent trace
+type TraceStep struct {
+	Kind         string       `json:"kind"` // model or tool
+	LogId        int64        `json:"log_id"`
+	Name         string       `json:"name"` // the model, or the function called
+	Provider     string       `json:"provider,omitempty"`
+	StartMs      int64        `json:"start_ms"` // since the conversation started
+	DurationMs   int          `json:"duration_ms"`
+	State        string       `json:"state,omitempty"`
+	Status       int          `json:"response_status,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	Input        string       `json:"input,omitempty"`  // new user messages, or the tool arguments
+	Output       string       `json:"output,omitempty"` // the response text, or the tool result
+	ToolCallId   string       `json:"tool_call_id,omitempty"`
+	ResultLogId  int64        `json:"result_log_id,omitempty"` // the request that sent the tool result back
+	Pending      bool         `json:"pending,omitempty"`       // no tool result was sent back
+	FinishReason string       `json:"finish_reason,omitempty"`
+	Usage        *ChatUsage   `json:"usage,omitempty"`
+	Steps        []*TraceStep `json:"steps,omitempty"`
+}
+
+// AgentTrace is the tool-calling loop of a conversation: each model call
+// with the tool calls it made, in order
+type AgentTrace struct {
+	Id         string       `json:"id"`
+	ModelCalls int          `json:"model_calls"`
+	ToolCalls  int          `json:"tool_calls"`
+	ModelMs    int          `json:"model_ms"`    // time spent waiting on models
+	DurationMs int64        `json:"duration_ms"` // from the first request to the end of the last
+	Steps      []*TraceStep `json:"steps"`
+}
+
+// buildAgentTrace pairs the tool calls in each response with the tool
+// results sent in later requests. Request timestamps are to the second, so
+// tool durations, the gap between a response and the request carrying its
+// result, are approximate; model durations are exact.
+func buildAgentTrace(id string, turns []ConversationTurn) *AgentTrace {
+	trace := &AgentTrace{Id: id, Steps: []*TraceStep{}}
+	if len(turns) == 0 {
+		return trace
+	}
+
+	started, _ := time.Parse(time.RFC3339, turns[0].Timestamp)
+	var pending []*TraceStep // tool calls waiting for their result, oldest first
+	var ended time.Time      // end of the previous model call
+
+	for _, turn := range turns {
+		at, _ := time.Parse(time.RFC3339, turn.Timestamp)
+
+		// tool results answer calls by id, or by name and order for clients without ids
+		var input []string
+		for _, message := range turn.Messages {
+			switch message.Role {
+			case "tool", "function":
+				call := takeToolCall(&pending, message)
+				if call == nil {
+					continue
+				}
+				call.Output = message.Text()
+				call.ResultLogId = turn.Id
+				call.Pending = false
+				if !ended.IsZero() && at.After(ended) {
+					call.DurationMs = int(at.Sub(ended).Milliseconds())
+				}
+			case "user":
+				input = append(input, message.Text())
+			}
+		}
+
+		step := &TraceStep{
+			Kind:       "model",
+			LogId:      turn.Id,
+			Name:       turn.Model,
+			Provider:   turn.Provider,
+			StartMs:    at.Sub(started).Milliseconds(),
+			DurationMs: max(turn.DurationMs, 0),
+			State:      turn.State,
+			Status:     turn.ResponseStatus,
+			Error:      turn.Error,
+			Input:      strings.Join(input, "\n"),
+			Usage:      turn.Usage,
+		}
+		trace.ModelCalls++
+		trace.ModelMs += step.DurationMs
+		ended = at.Add(time.Duration(step.DurationMs) * time.Millisecond)
+		trace.DurationMs = max(trace.DurationMs, ended.Sub(started).Milliseconds())
+
+		if turn.Response != nil {
+			step.Output = turn.Response.Text()
+			step.FinishReason = turn.FinishReason
+			for _, call := range turn.Response.ToolCalls {
+				tool := &TraceStep{
+					Kind:       "tool",
+					LogId:      turn.Id,
+					Name:       call.Function.Name,
+					StartMs:    ended.Sub(started).Milliseconds(),
+					Input:      call.Function.Arguments,
+					ToolCallId: call.Id,
+					Pending:    true,
+				}
+				step.Steps = append(step.Steps, tool)
+				pending = append(pending, tool)
+				trace.ToolCalls++
+			}
+		}
+
+		trace.Steps = append(trace.Steps, step)
+	}
+
+	return trace
+}
+
+// takeToolCall removes and returns the pending call a tool result answers
+func takeToolCall(pending *[]*TraceStep, result ChatMessage) *TraceStep {
+	match := -1
+	for i, call := range *pending {
+		if result.ToolCallId != "" && call.ToolCallId == result.ToolCallId {
+			match = i
+			break
+		}
+		if result.ToolCallId == "" && match < 0 && (result.Name == "" || call.Name == result.Name) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil
+	}
+	call := (*pending)[match]
+	*pending = append((*pending)[:match], (*pending)[match+1:]...)
+	return call
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// authorizeAdmin guards endpoints that change state. Only POST and DELETE
+// requests are accepted, so that links and image tags can't act for the UI.
+// Requests must come from the same origin, and carry the admin token when one
+// is configured; without a token only local clients are allowed. It writes
+// the error response and returns false when the request is refused.
+func (s *ProxyServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return false
+	}
+
+	// browsers send Origin with cross-site POSTs, which must not be able to act for the UI
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, `{"error":"Cross-origin request refused"}`, http.StatusForbidden)
+			return false
+		}
+	}
+
+	token := s.currentConfig().AdminToken
+	if token == "" {
+		if !isLoopback(r.RemoteAddr) {
+			http.Error(w, `{"error":"Set admintoken in the config to allow remote access"}`, http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	given := r.Header.Get("X-Llmsee-Token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		given = bearer
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, `{"error":"Invalid or missing admin token"}`, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isLoopback reports whether a remote address is on the local machine
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
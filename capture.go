@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// captureMarkerPrefix starts the marker ending a logged body cut at the
+// capture limit
+const captureMarkerPrefix = "\n[llmsee: body truncated, logged "
+
+// captureTruncatedMarker ends a logged body cut at the capture limit
+const captureTruncatedMarker = captureMarkerPrefix + "%d of %d bytes]"
+
+// captureCompressedMarker ends a logged body cut at the capture limit whose
+// full size is only known compressed
+const captureCompressedMarker = captureMarkerPrefix + "%d bytes of %d bytes received %s-compressed]"
+
+// captureBuffer keeps the first limit bytes written to it for the log, and
+// counts the rest
+type captureBuffer struct {
+	bytes.Buffer
+	limit int
+	total int
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	c.total += len(p)
+	if room := c.limit - c.Len(); room > 0 {
+		c.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// truncated reports whether anything was left out
+func (c *captureBuffer) truncated() bool {
+	return c.total > c.Len()
+}
+
+// isCaptureTruncated reports whether a logged body ends in a truncation marker
+func isCaptureTruncated(body string) bool {
+	i := strings.LastIndex(body, captureMarkerPrefix)
+	return i >= 0 && strings.HasSuffix(body, "]") && !strings.Contains(body[i+1:], "\n")
+}
+
+// captureBody is the logged form of a body of size bytes, of which body was
+// captured: cut to limit, with a marker when anything is missing. A body
+// decompressed from a cut capture passes its encoding, size then being the
+// compressed size.
+func captureBody(body []byte, size, limit int, encoding string) string {
+	if encoding == "" {
+		size = max(size, len(body))
+		if size <= limit {
+			return string(body)
+		}
+	}
+
+	// don't end in part of a character
+	body = body[:min(len(body), limit)]
+	for i := len(body) - 1; i >= 0 && i >= len(body)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(body[i]) {
+			if !utf8.FullRune(body[i:]) {
+				body = body[:i]
+			}
+			break
+		}
+	}
+
+	if encoding != "" {
+		return string(body) + fmt.Sprintf(captureCompressedMarker, len(body), size, encoding)
+	}
+	return string(body) + fmt.Sprintf(captureTruncatedMarker, len(body), size)
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// providerTestTimeout limits each request made by providers test
+const providerTestTimeout = 15 * time.Second
+
+// cliUsage lists the subcommands, printed by -h
+const cliUsage = `Usage: llmsee [-c <config>] [-ignore-invalid-config] <command> [arguments]
+
+Commands:
+  serve                            Start the proxy and web UI (default)
+  tail [-url <url>]                Stream live requests from a running server
+  ls [-n <count>] [filters]        List recent requests
+  show [-json] <id>                Show a request and its response
+  export [-format <fmt>] [-o <file>] [filters]
+                                   Export requests as jsonl, csv, har or finetune
+  import <file>...                 Import JSONL or HAR files
+  prune -older-than <age> | -keep <count> [-dry-run]
+                                   Delete old requests
+  stats [-group <by>] [filters]    Summarise requests, tokens and cost by model,
+                                   provider or meta.<key>
+  marker [-url <url>] [name]       Place a marker on a running server
+  marker -ls [-url <url>]          List the markers
+  providers test                   Check each provider's /models endpoint
+  config validate [file]           Validate a config file
+  config convert <in> <out>        Convert a config file between JSON, YAML and TOML
+
+Filters: -provider <name> -model <name> -status <code> -from <time> -to <time>
+         -conversation <id> -tag <tag> -starred -from-marker <marker> -to-marker <marker>
+         -meta <key>=<value>
+
+Global flags:
+`
+
+// printUsage writes the command list and global flags to stderr
+func printUsage() {
+	fmt.Fprint(flag.CommandLine.Output(), cliUsage)
+	flag.PrintDefaults()
+}
+
+// runCommand executes a CLI subcommand
+func runCommand(configFile string, args []string) error {
+	switch args[0] {
+	case "serve":
+		return runServe(configFile)
+	case "tail":
+		return runTail(configFile, args[1:])
+	case "config":
+		return runConfigCommand(configFile, args[1:])
+	case "providers":
+		return runProvidersCommand(configFile, args[1:])
+	case "marker":
+		return runMarker(configFile, args[1:])
+	case "import", "ls", "show", "export", "prune", "stats":
+		return runDatabaseCommand(configFile, args[0], args[1:])
+	case "help":
+		printUsage()
+		return nil
+	default:
+		printUsage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runDatabaseCommand runs a command that works directly on the database
+func runDatabaseCommand(configFile, command string, args []string) error {
+	s, err := NewProxyServer(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to initialize server: %w", err)
+	}
+	defer s.Close()
+
+	switch command {
+	case "import":
+		return runImport(s, args)
+	case "ls":
+		return runList(s, args)
+	case "show":
+		return runShow(s, args)
+	case "export":
+		return runExport(s, args)
+	case "prune":
+		return runPrune(s, args)
+	default:
+		return runStats(s, args)
+	}
+}
+
+// addFilterFlags registers the log filter flags shared by ls, export and stats
+func addFilterFlags(fs *flag.FlagSet) *LogFilter {
+	filter := &LogFilter{}
+	fs.StringVar(&filter.Provider, "provider", "", "Only requests to this provider")
+	fs.StringVar(&filter.Model, "model", "", "Only requests for this model")
+	fs.IntVar(&filter.Status, "status", 0, "Only responses with this HTTP status")
+	fs.StringVar(&filter.From, "from", "", "Only requests at or after this RFC3339 time")
+	fs.StringVar(&filter.To, "to", "", "Only requests at or before this RFC3339 time")
+	fs.StringVar(&filter.Conversation, "conversation", "", "Only requests in this conversation")
+	fs.StringVar(&filter.Tag, "tag", "", "Only requests with this tag")
+	fs.BoolVar(&filter.Starred, "starred", false, "Only starred requests")
+	fs.StringVar(&filter.FromMarker, "from-marker", "", "Only requests after this marker (name or id)")
+	fs.StringVar(&filter.ToMarker, "to-marker", "", "Only requests before this marker (name or id)")
+	fs.Func("meta", "Only requests with this metadata, as key=value (repeatable)", func(value string) error {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value")
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = make(map[string]string)
+		}
+		filter.Metadata[key] = val
+		return nil
+	})
+	return filter
+}
+
+// runImport loads one or more JSONL or HAR files into the database
+func runImport(s *ProxyServer, files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("usage: llmsee import <file.jsonl|file.har>...")
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		result, err := s.importLogs(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", file, err)
+		}
+		log.Printf("Imported %s: %d imported, %d skipped", file, result.Imported, result.Skipped)
+	}
+	return nil
+}
+
+// runList prints the most recent requests, newest first
+func runList(s *ProxyServer, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	count := fs.Int("n", 20, "Number of requests to list")
+	filter := addFilterFlags(fs)
+	fs.Parse(args)
+	if err := s.resolveLogFilter(filter); err != nil {
+		return err
+	}
+
+	logs, err := s.store.ListLogs(*filter, *count, 0)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tPROVIDER\tMODEL\tMETHOD\tSTATUS\tDURATION\tREQUEST\tRESPONSE")
+	for _, entry := range logs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Id, entry.Timestamp, entry.Provider, entry.Model, entry.Method,
+			formatOutcome(entry), formatDuration(entry.DurationMs),
+			formatSize(entry.RequestBodySize), formatSize(entry.ResponseBodySize))
+	}
+	return tw.Flush()
+}
+
+// runShow prints one request and its response
+func runShow(s *ProxyServer, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the raw log entry as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: llmsee show [-json] <id>")
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid log id %q", fs.Arg(0))
+	}
+
+	entry, err := s.store.GetLog(id)
+	if err != nil {
+		return fmt.Errorf("log entry %d: %w", id, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entry)
+	}
+
+	fmt.Printf("#%d %s %s %s\n", entry.Id, entry.Timestamp, entry.Method, entry.TargetURL)
+	fmt.Printf("Provider: %s  Model: %s  Status: %s  Duration: %s\n",
+		entry.Provider, entry.Model, formatOutcome(entry), formatDuration(entry.DurationMs))
+	if entry.Error != "" {
+		fmt.Printf("Error: %s\n", entry.Error)
+	}
+	if entry.UserAgent != "" {
+		fmt.Printf("User-Agent: %s\n", entry.UserAgent)
+	}
+
+	printSection("Request Headers", entry.RequestHeaders)
+	printSection("Request Body", entry.RequestBody)
+	printSection("Response Headers", entry.ResponseHeaders)
+	if response, ok := parseChatResponse(entry.ResponseBody); ok && response.Chunks > 0 {
+		// streamed responses are easier to read reassembled
+		message, _ := json.Marshal(response.Message)
+		printSection(fmt.Sprintf("Response Message (%d chunks, reassembled)", response.Chunks), string(message))
+		if response.Usage != nil {
+			fmt.Printf("Finish reason: %s  Tokens: %d prompt, %d completion\n",
+				response.FinishReason, response.Usage.PromptTokens, response.Usage.CompletionTokens)
+		}
+	} else {
+		printSection("Response Body", entry.ResponseBody)
+	}
+	return nil
+}
+
+// printSection prints a titled block, indenting JSON values
+func printSection(title, body string) {
+	fmt.Printf("\n== %s ==\n", title)
+	var indented strings.Builder
+	var value interface{}
+	if json.Unmarshal([]byte(body), &value) == nil {
+		enc := json.NewEncoder(&indented)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if enc.Encode(value) == nil {
+			body = indented.String()
+		}
+	}
+	fmt.Println(strings.TrimRight(body, "\n"))
+}
+
+// runExport writes the filtered requests to a file or stdout
+func runExport(s *ProxyServer, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "Export format: jsonl, csv, har or finetune")
+	output := fs.String("o", "", "Output file (default stdout)")
+	dedupe := fs.Bool("dedupe", false, "finetune: skip repeated prompts")
+	skipRedacted := fs.Bool("skip-redacted", false, "finetune: skip entries with redacted content")
+	filter := addFilterFlags(fs)
+	fs.Parse(args)
+	if err := s.resolveLogFilter(filter); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	exporter, err := newLogExporter(w, *format, filter, *dedupe, *skipRedacted)
+	if err != nil {
+		return err
+	}
+
+	return exporter.write(s.store, *filter)
+}
+
+// runPrune deletes requests older than an age, or all but the newest ones
+func runPrune(s *ProxyServer, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	olderThan := fs.String("older-than", "", "Delete requests older than this age, e.g. 30d or 12h")
+	keep := fs.Int("keep", 0, "Delete all but this many of the newest requests")
+	dryRun := fs.Bool("dry-run", false, "Only count the requests that would be deleted")
+	vacuum := fs.Bool("vacuum", false, "Reclaim disk space after deleting")
+	fs.Parse(args)
+
+	var before time.Time
+	switch {
+	case *olderThan != "" && *keep > 0:
+		return fmt.Errorf("use either -older-than or -keep, not both")
+	case *olderThan != "":
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+		before = time.Now().Add(-age)
+	case *keep > 0:
+	default:
+		return fmt.Errorf("usage: llmsee prune -older-than <age> | -keep <count> [-dry-run] [-vacuum]")
+	}
+
+	deleted, payloads, err := s.store.PruneLogs(before, *keep, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("Would delete %d request(s)", deleted)
+		return nil
+	}
+	log.Printf("Deleted %d request(s) and %d unused payload(s)", deleted, payloads)
+
+	if *vacuum {
+		return s.store.Vacuum()
+	}
+	return nil
+}
+
+// parseAge parses a duration, also accepting a number of days like 30d
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected e.g. 30d or 12h", value)
+	}
+	return age, nil
+}
+
+// runStats summarises the filtered requests by provider and model, or by
+// another grouping
+func runStats(s *ProxyServer, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	group := fs.String("group", "model", "Group by model, provider or meta.<key>")
+	filter := addFilterFlags(fs)
+	fs.Parse(args)
+	if err := s.resolveLogFilter(filter); err != nil {
+		return err
+	}
+
+	list, total, err := s.computeStats(*filter, *group)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	columns := "PROVIDER\tMODEL"
+	if *group != "model" {
+		columns = strings.ToUpper(*group)
+	}
+	fmt.Fprintln(tw, columns+"\tREQUESTS\tERRORS\tPENDING\tAVG\tMAX\tPROMPT TOKENS\tCOMPLETION TOKENS\tCOST")
+	for _, stat := range append(list, total) {
+		cost := "-"
+		if stat.Priced {
+			cost = formatCost(stat.Cost)
+		}
+		name := stat.Provider + "\t" + stat.Model
+		if *group != "model" {
+			name = defaultString(stat.Group, "-")
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%d\t%d\t%s\n",
+			name, stat.Requests, stat.Errors, stat.Pending,
+			formatDuration(stat.AvgMs), formatDuration(stat.MaxMs), stat.PromptTokens, stat.CompletionTokens, cost)
+	}
+	return tw.Flush()
+}
+
+// runMarker places a marker on a running server, so that every UI and tail
+// sees it, or lists the markers
+func runMarker(configFile string, args []string) error {
+	fs := flag.NewFlagSet("marker", flag.ExitOnError)
+	serverURL := fs.String("url", "", "URL of the llmsee server (default from the config)")
+	list := fs.Bool("ls", false, "List the markers instead")
+	fs.Parse(args)
+
+	config, err := getConfig(configFile)
+	if err != nil && *serverURL == "" {
+		return err
+	}
+	if *serverURL == "" {
+		*serverURL = localServerURL(config)
+	}
+	markerURL := strings.TrimRight(*serverURL, "/") + "/marker"
+
+	var req *http.Request
+	if *list {
+		req, err = http.NewRequest("GET", markerURL, nil)
+	} else {
+		req, err = http.NewRequest("POST", markerURL+"?name="+url.QueryEscape(strings.Join(fs.Args(), " ")), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if config != nil && config.AdminToken != "" {
+		req.Header.Set("X-Llmsee-Token", config.AdminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if !*list {
+		var marker Marker
+		if err := json.NewDecoder(resp.Body).Decode(&marker); err != nil {
+			return err
+		}
+		fmt.Printf("Marker %d %q after request %d\n", marker.Id, marker.Name, marker.LogId)
+		return nil
+	}
+
+	var markers []Marker
+	if err := json.NewDecoder(resp.Body).Decode(&markers); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "ID\tTIME\tAFTER\tNAME")
+	for _, marker := range markers {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\n", marker.Id, marker.Timestamp, marker.LogId, marker.Name)
+	}
+	return nil
+}
+
+// runProvidersCommand handles the providers subcommands
+func runProvidersCommand(configFile string, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return fmt.Errorf("usage: llmsee providers test [provider]...")
+	}
+
+	config, err := getConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range config.Providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	client := &http.Client{Timeout: providerTestTimeout}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tSTATUS\tMODELS\tDURATION\tRESULT")
+	defer tw.Flush()
+
+	failed := 0
+	for _, name := range names {
+		providerConfig, ok := config.Providers[name]
+		if !ok {
+			return fmt.Errorf("unknown or disabled provider %q", name)
+		}
+
+		status, models, duration, err := testProvider(client, providerConfig)
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, formatStatus(status), formatCount(models), formatDuration(duration), result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d provider(s) failed", failed, len(names))
+	}
+	return nil
+}
+
+// testProvider requests the provider's model list, returning the status, the
+// number of models (-1 if unknown) and the time taken
+func testProvider(client *http.Client, providerConfig ProviderConfig) (status, models, durationMs int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), providerTestTimeout)
+	defer cancel()
+
+	url := providerConfig.BaseURL + "/models"
+	headers := proxyHeaders(http.Header{}, providerConfig, nil)
+	if providerConfig.IsGemini {
+		url = geminiBaseURL + "/models?key=" + providerConfig.ApiKey
+		headers.Del("Authorization")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return -1, -1, -1, err
+	}
+	req.Header = headers
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error includes the URL, which may hold an API key
+		return -1, -1, -1, fmt.Errorf("request failed: %v", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	durationMs = int(time.Since(start).Milliseconds())
+	if err != nil {
+		return resp.StatusCode, -1, durationMs, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, -1, durationMs, fmt.Errorf("%s", strings.TrimSpace(truncate(string(body), 200)))
+	}
+
+	var list struct {
+		Data   []json.RawMessage `json:"data"`
+		Models []json.RawMessage `json:"models"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return resp.StatusCode, -1, durationMs, fmt.Errorf("response is not a model list: %w", err)
+	}
+	return resp.StatusCode, len(list.Data) + len(list.Models), durationMs, nil
+}
+
+// formatStatus shows pending requests as "-"
+func formatStatus(status int) string {
+	if status < 0 {
+		return "-"
+	}
+	return strconv.Itoa(status)
+}
+
+// formatOutcome shows the status of completed requests, and the state of the others
+func formatOutcome(entry LogEntry) string {
+	if entry.State == logStateCompleted || entry.State == logStateInFlight || entry.State == "" {
+		return formatStatus(entry.ResponseStatus)
+	}
+	return entry.State
+}
+
+// formatCount shows unknown counts as "-"
+func formatCount(count int) string {
+	if count < 0 {
+		return "-"
+	}
+	return strconv.Itoa(count)
+}
+
+// formatDuration shows milliseconds as ms or s, and unknown durations as "-"
+func formatDuration(ms int) string {
+	switch {
+	case ms < 0:
+		return "-"
+	case ms < 1000:
+		return fmt.Sprintf("%dms", ms)
+	default:
+		return fmt.Sprintf("%.1fs", float64(ms)/1000)
+	}
+}
+
+// formatCost shows small costs with enough digits to not round to zero
+func formatCost(cost float64) string {
+	if cost < 0.01 {
+		return fmt.Sprintf("$%.6f", cost)
+	}
+	return fmt.Sprintf("$%.4f", cost)
+}
+
+// formatSize shows a byte count in B, KB or MB
+func formatSize(size int) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%dB", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1fKB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%.1fMB", float64(size)/1024/1024)
+	}
+}
+
+// truncate shortens a string to at most n bytes, without splitting a
+// character
+func truncate(value string, n int) string {
+	if len(value) <= n {
+		return value
+	}
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + "..."
+}
+
+// runConfigCommand handles the config subcommands
+func runConfigCommand(configFile string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: llmsee config validate [file] | llmsee config convert <in> <out>")
+	}
+
+	switch args[0] {
+	case "validate":
+		if len(args) > 1 {
+			configFile = args[1]
+		}
+		if configFile == "" {
+			return fmt.Errorf("no config file found, use -c <file> or llmsee config validate <file>")
+		}
+		if _, err := loadConfig(configFile); err != nil {
+			return err
+		}
+		log.Printf("Config file %s is valid", configFile)
+		return nil
+	case "convert":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: llmsee config convert <in> <out>")
+		}
+		return convertConfig(args[1], args[2])
+	default:
+		return fmt.Errorf("unknown config command %q", args[0])
+	}
+}
+
+// convertConfig rewrites a config file in the format given by the output file's extension
+func convertConfig(in, out string) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+
+	raw, _, problem := decodeConfigDocument(configFormat(in), data)
+	if problem != nil {
+		return newConfigError(in, nil, []ConfigProblem{*problem})
+	}
+
+	converted, err := encodeConfigDocument(configFormat(out), raw)
+	if err != nil {
+		return fmt.Errorf("failed to convert %s: %w", in, err)
+	}
+	if err := os.WriteFile(out, converted, 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Converted %s to %s", in, out)
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tailReconnectDelay = 2 * time.Second  // Delay before reconnecting to the server
+	tailMaxEventSize   = 64 * 1024 * 1024 // Largest SSE event accepted, entries carry bodies
+	tailExpandIndent   = "    "
+)
+
+// ANSI colours used by the tail view
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiDim    = "\033[2m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiBlue   = "\033[34m"
+	ansiCyan   = "\033[36m"
+)
+
+// tailView renders server updates as one line per request
+type tailView struct {
+	out       io.Writer
+	color     bool
+	expand    bool
+	pending   bool
+	provider  string
+	model     string
+	errors    bool
+	providers map[string]ProviderConfig
+
+	// streams holds the responses being expanded live, by log id
+	streams    map[int64]*tailStream
+	lastStream int64
+}
+
+// tailStream is a streaming response as received from chunk events
+type tailStream struct {
+	partial string // start of a line whose end hasn't arrived yet
+	seq     int    // of the last chunk event
+	printed bool
+	gap     bool // chunk events were dropped on the way
+}
+
+// runTail streams live requests from a running server's /ui/sse to the terminal
+func runTail(configFile string, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	serverURL := fs.String("url", "", "URL of the llmsee server (default from the config)")
+	colorMode := fs.String("color", "auto", "Colourise output: auto, always or never")
+	view := &tailView{out: os.Stdout, streams: make(map[int64]*tailStream)}
+	fs.StringVar(&view.provider, "provider", "", "Only requests to this provider")
+	fs.StringVar(&view.model, "model", "", "Only requests for this model")
+	fs.BoolVar(&view.errors, "errors", false, "Only failed requests")
+	fs.BoolVar(&view.expand, "expand", false, "Print the reassembled response under each request")
+	fs.BoolVar(&view.pending, "pending", false, "Also print a line when each request starts")
+	fs.Parse(args)
+
+	// the config is optional with -url, it only adds prices
+	config, err := getConfig(configFile)
+	if err != nil && *serverURL == "" {
+		return err
+	}
+	if config != nil {
+		view.providers = config.Providers
+	}
+
+	switch *colorMode {
+	case "always":
+		view.color = true
+	case "never":
+		view.color = false
+	case "auto":
+		view.color = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	default:
+		return fmt.Errorf("invalid -color %q, expected auto, always or never", *colorMode)
+	}
+
+	if *serverURL == "" {
+		*serverURL = localServerURL(config)
+	}
+	sseURL := strings.TrimRight(*serverURL, "/") + "/ui/sse"
+
+	for {
+		err := tailEvents(sseURL, view.render)
+		log.Printf("Disconnected from %s: %v, reconnecting", sseURL, err)
+		time.Sleep(tailReconnectDelay)
+	}
+}
+
+// localServerURL is the address of the server started with the config
+func localServerURL(config *Config) string {
+	host := config.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(config.Port))
+}
+
+// isTerminal reports whether the file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// tailEvents reads server updates until the connection ends
+func tailEvents(sseURL string, handle func(ServerUpdate)) error {
+	resp, err := http.Get(sseURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	log.Printf("Connected to %s", sseURL)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), tailMaxEventSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var update ServerUpdate
+		if err := json.Unmarshal([]byte(data), &update); err != nil {
+			log.Printf("failed to decode event: %v", err)
+			continue
+		}
+		handle(update)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("connection closed")
+}
+
+// paint wraps text in an ANSI colour when colours are enabled
+func (v *tailView) paint(color, text string) string {
+	if !v.color || color == "" {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+// matches applies the provider, model and error filters
+func (v *tailView) matches(entry LogEntry, completed bool) bool {
+	if v.provider != "" && entry.Provider != v.provider {
+		return false
+	}
+	if v.model != "" && entry.Model != v.model {
+		return false
+	}
+	if v.errors && (!completed || (entry.State == logStateCompleted && entry.ResponseStatus < 400)) {
+		return false
+	}
+	return true
+}
+
+// render prints a server update
+func (v *tailView) render(update ServerUpdate) {
+	entry := update.Entry
+	switch update.EventType {
+	case "insert":
+		if v.pending && v.matches(entry, false) {
+			v.endStreamLine()
+			fmt.Fprintf(v.out, "%s %s %s %s %s %s\n",
+				v.paint(ansiDim, tailTime(entry.Timestamp)),
+				v.paint(ansiDim, fmt.Sprintf("#%-5d", entry.Id)),
+				v.paint(ansiDim, "..."),
+				v.paint(ansiCyan, entry.Provider),
+				v.paint(ansiBold, entry.Model),
+				v.paint(ansiDim, entry.Method+" "+entry.TargetURL))
+		}
+
+	case "chunk":
+		if v.expand && !v.errors && v.matches(entry, false) {
+			v.renderChunk(entry, update.Chunk, update.Seq)
+		}
+
+	case "update":
+		stream := v.streams[entry.Id]
+		delete(v.streams, entry.Id)
+		if v.matches(entry, true) {
+			// text with a gap in it is printed again in full
+			v.renderCompleted(entry, stream != nil && stream.printed && !stream.gap)
+		}
+
+	case "config":
+		v.endStreamLine()
+		fmt.Fprintf(v.out, "%s\n", v.paint(ansiBlue, "config: "+update.Message))
+
+	case "marker":
+		if update.Marker != nil {
+			v.endStreamLine()
+			fmt.Fprintf(v.out, "%s %s\n",
+				v.paint(ansiDim, tailTime(update.Marker.Timestamp)),
+				v.paint(ansiBold+ansiBlue, "──── "+update.Marker.Name+" ────"))
+		}
+	}
+}
+
+// renderChunk prints the text of a streaming response as it arrives,
+// labelling it whenever output switches between concurrent streams. Only the
+// lines completed by the chunk are parsed; a skipped seq shows as a gap.
+func (v *tailView) renderChunk(entry LogEntry, chunk string, seq int) {
+	stream := v.streams[entry.Id]
+	if stream == nil {
+		stream = &tailStream{}
+		v.streams[entry.Id] = stream
+	}
+
+	missed := seq != stream.seq+1
+	stream.seq = seq
+	if missed {
+		// the line cut off by the gap can't be completed anymore
+		stream.partial = ""
+		stream.gap = true
+	}
+
+	lines := strings.Split(stream.partial+chunk, "\n")
+	stream.partial = lines[len(lines)-1]
+	var text strings.Builder
+	for _, line := range lines[:len(lines)-1] {
+		parsed, ok := parseStreamLine(line)
+		if ok && len(parsed.Choices) > 0 && parsed.Choices[0].Delta.Content != nil {
+			text.WriteString(*parsed.Choices[0].Delta.Content)
+		}
+	}
+	if text.Len() == 0 && !missed {
+		return
+	}
+
+	if v.lastStream != entry.Id {
+		v.endStreamLine()
+		label := fmt.Sprintf("#%d %s %s ▸ ", entry.Id, entry.Provider, entry.Model)
+		fmt.Fprint(v.out, tailExpandIndent+v.paint(ansiDim, label))
+		v.lastStream = entry.Id
+	}
+	if missed {
+		fmt.Fprint(v.out, v.paint(ansiYellow, "[…]"))
+	}
+	fmt.Fprint(v.out, strings.ReplaceAll(text.String(), "\n", "\n"+tailExpandIndent))
+	stream.printed = true
+}
+
+// endStreamLine finishes a line of streamed text before anything else is printed
+func (v *tailView) endStreamLine() {
+	if v.lastStream != 0 {
+		fmt.Fprintln(v.out)
+		v.lastStream = 0
+	}
+}
+
+// renderCompleted prints the line for a finished request, and its response
+// when expanded; streamed text that was already printed isn't repeated
+func (v *tailView) renderCompleted(entry LogEntry, streamed bool) {
+	v.endStreamLine()
+	response, parsed := parseChatResponse(entry.ResponseBody)
+
+	tokens := ""
+	if parsed && response.Usage != nil {
+		tokens = fmt.Sprintf("%d→%d tok", response.Usage.PromptTokens, response.Usage.CompletionTokens)
+		providerConfig := v.providers[entry.Provider]
+		if cost, ok := providerConfig.Cost(entry.Model, response.Usage); ok {
+			tokens += " " + formatCost(cost)
+		}
+	}
+	if parsed && response.Chunks > 0 {
+		tokens += fmt.Sprintf(" %d chunks", response.Chunks)
+	}
+
+	fmt.Fprintf(v.out, "%s %s %s %s %s %s %s %s\n",
+		v.paint(ansiDim, tailTime(entry.Timestamp)),
+		v.paint(ansiDim, fmt.Sprintf("#%-5d", entry.Id)),
+		v.paint(outcomeColor(entry), fmt.Sprintf("%3s", formatOutcome(entry))),
+		v.paint(ansiCyan, entry.Provider),
+		v.paint(ansiBold, entry.Model),
+		fmt.Sprintf("%7s", formatDuration(entry.DurationMs)),
+		v.paint(ansiDim, formatSize(entry.ResponseBodySize)),
+		tokens)
+
+	if !v.expand {
+		return
+	}
+
+	if entry.Error != "" {
+		fmt.Fprintf(v.out, "%s%s\n", tailExpandIndent, v.paint(ansiRed, entry.Error))
+	}
+
+	switch {
+	case parsed:
+		if streamed {
+			response.Message.Content = nil
+		}
+		v.renderMessage(response.Message)
+		if response.FinishReason != "" && response.FinishReason != "stop" {
+			fmt.Fprintf(v.out, "%s%s\n", tailExpandIndent, v.paint(ansiYellow, "finish: "+response.FinishReason))
+		}
+	case entry.ResponseStatus >= 400:
+		fmt.Fprintf(v.out, "%s%s\n", tailExpandIndent, v.paint(ansiRed, truncate(strings.TrimSpace(entry.ResponseBody), 500)))
+	}
+}
+
+// renderMessage prints the assistant text and tool calls, indented
+func (v *tailView) renderMessage(message ChatMessage) {
+	if text := strings.TrimSpace(message.Text()); text != "" {
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Fprintf(v.out, "%s%s\n", tailExpandIndent, line)
+		}
+	}
+	for _, call := range message.ToolCalls {
+		fmt.Fprintf(v.out, "%s%s\n", tailExpandIndent,
+			v.paint(ansiYellow, fmt.Sprintf("→ %s(%s)", call.Function.Name, truncate(call.Function.Arguments, 200))))
+	}
+}
+
+// outcomeColor picks green for success, yellow for client errors and red for
+// server errors and failed requests
+func outcomeColor(entry LogEntry) string {
+	status := entry.ResponseStatus
+	switch {
+	case entry.State != logStateCompleted:
+		return ansiRed
+	case status >= 500:
+		return ansiRed
+	case status >= 400:
+		return ansiYellow
+	default:
+		return ansiGreen
+	}
+}
+
+// tailTime shows the local time of day of an RFC3339 timestamp
+func tailTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Local().Format("15:04:05")
+}
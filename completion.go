@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type ToolCall struct {
+	Index    int              `json:"-"`
+	Id       string           `json:"id,omitempty"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ChatMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
+	ToolCallId string          `json:"tool_call_id,omitempty"`
+}
+
+// Text returns the message content as plain text, joining the text parts of
+// multi-part content
+func (m ChatMessage) Text() string {
+	var text string
+	if json.Unmarshal(m.Content, &text) == nil {
+		return text
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(m.Content, &parts) != nil {
+		return ""
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+type ChatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ChatRequest struct {
+	Model    string            `json:"model"`
+	Messages []ChatMessage     `json:"messages"`
+	Tools    []json.RawMessage `json:"tools,omitempty"`
+	Stream   bool              `json:"stream"`
+}
+
+// ChatResponse is a chat completion response, reassembled if it was streamed
+type ChatResponse struct {
+	Id           string
+	Model        string
+	Message      ChatMessage
+	FinishReason string
+	Usage        *ChatUsage
+	Chunks       int
+}
+
+type chatChoice struct {
+	Message struct {
+		Role      string          `json:"role"`
+		Content   json.RawMessage `json:"content"`
+		ToolCalls []ToolCall      `json:"tool_calls"`
+	} `json:"message"`
+	Delta struct {
+		Role      string  `json:"role"`
+		Content   *string `json:"content"`
+		ToolCalls []struct {
+			Index    int    `json:"index"`
+			Id       string `json:"id"`
+			Type     string `json:"type"`
+			Function struct {
+				Name      string `json:"name"`
+				Arguments string `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type chatCompletion struct {
+	Id      string       `json:"id"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *ChatUsage   `json:"usage"`
+}
+
+// parseChatRequest decodes a chat completion request body
+func parseChatRequest(body string) (request ChatRequest, ok bool) {
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		return request, false
+	}
+	return request, len(request.Messages) > 0
+}
+
+// parseChatResponse decodes a chat completion response, streamed or not
+func parseChatResponse(body string) (response ChatResponse, ok bool) {
+	if isEventStream(body) {
+		return parseChatStream(body)
+	}
+
+	var completion chatCompletion
+	if err := json.Unmarshal([]byte(body), &completion); err != nil || len(completion.Choices) == 0 {
+		return response, false
+	}
+
+	choice := completion.Choices[0]
+	response = ChatResponse{
+		Id:    completion.Id,
+		Model: completion.Model,
+		Message: ChatMessage{
+			Role:      defaultString(choice.Message.Role, "assistant"),
+			Content:   choice.Message.Content,
+			ToolCalls: choice.Message.ToolCalls,
+		},
+		Usage: completion.Usage,
+	}
+	if choice.FinishReason != nil {
+		response.FinishReason = *choice.FinishReason
+	}
+	return response, true
+}
+
+// parseChatStream reassembles the deltas of a streamed chat completion
+func parseChatStream(body string) (response ChatResponse, ok bool) {
+	var content strings.Builder
+	toolCalls := make(map[int]*ToolCall)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), httpMaxRequestBodySize)
+	for scanner.Scan() {
+		chunk, ok := parseStreamLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		response.Chunks++
+
+		if response.Id == "" {
+			response.Id = chunk.Id
+		}
+		if response.Model == "" {
+			response.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			response.Usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta.Role != "" {
+			response.Message.Role = choice.Delta.Role
+		}
+		if choice.Delta.Content != nil {
+			content.WriteString(*choice.Delta.Content)
+		}
+		for _, delta := range choice.Delta.ToolCalls {
+			call, exists := toolCalls[delta.Index]
+			if !exists {
+				call = &ToolCall{Index: delta.Index, Type: "function"}
+				toolCalls[delta.Index] = call
+			}
+			if delta.Id != "" {
+				call.Id = delta.Id
+			}
+			if delta.Type != "" {
+				call.Type = delta.Type
+			}
+			call.Function.Name += delta.Function.Name
+			call.Function.Arguments += delta.Function.Arguments
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			response.FinishReason = *choice.FinishReason
+		}
+	}
+
+	if response.Chunks == 0 {
+		return response, false
+	}
+
+	response.Message.Role = defaultString(response.Message.Role, "assistant")
+	if content.Len() > 0 {
+		response.Message.Content, _ = json.Marshal(content.String())
+	}
+	for _, call := range toolCalls {
+		response.Message.ToolCalls = append(response.Message.ToolCalls, *call)
+	}
+	sort.Slice(response.Message.ToolCalls, func(i, j int) bool {
+		return response.Message.ToolCalls[i].Index < response.Message.ToolCalls[j].Index
+	})
+
+	return response, true
+}
+
+// parseStreamLine decodes the chunk carried by a data line of a streamed
+// chat completion
+func parseStreamLine(line string) (chunk chatCompletion, ok bool) {
+	data, found := strings.CutPrefix(line, "data:")
+	data = strings.TrimSpace(data)
+	if !found || data == "" || data == "[DONE]" {
+		return chunk, false
+	}
+	return chunk, json.Unmarshal([]byte(data), &chunk) == nil
+}
+
+// isEventStream reports whether a body looks like server-sent events
+func isEventStream(body string) bool {
+	return strings.HasPrefix(strings.TrimSpace(body), "data:")
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,9 +12,11 @@ import (
 	"time"
 )
 
+// configFileNames are searched for in order in each config directory
+var configFileNames = []string{"llmsee.json", "llmsee.yaml", "llmsee.yml", "llmsee.toml"}
+
 // System configuration
 const (
-	defaultConfigFile         = "llmsee.json"
 	clientIdleConnTimeout     = 90 * time.Second // Timeout for idle HTTP client
 	clientMaxIdleConns        = 100              // Max idle connections for HTTP client
 	clientMaxIdleConnsPerHost = 10               // Max idle connections per host for HTTP client
@@ -23,10 +25,17 @@ const (
 	dbMaxOpenConns            = 5                // Maximum open database connections
 	httpIdleConnTimeout       = 90 * time.Second // Timeout for idle HTTP server
 	httpMaxHeaderBytes        = 1 << 20          // 1MB for HTTP max header size
+	httpMaxImportSize         = 512 << 20        // 512MB max size for an uploaded import
 	httpMaxRequestBodySize    = 10 << 20         // 10MB max size for request body
 	httpReadTimeout           = 1 * time.Hour    // Timeout for reading requests
 	httpRequestTimeout        = 1 * time.Hour    // HTTP request timeout
 	httpWriteTimeout          = 1 * time.Hour    // Timeout for writing responses
+	logIdBlock                = 100              // Log ids reserved at a time
+	logInFlightCheck          = 10 * time.Minute // How often a shared database is checked for expired requests
+	logInFlightExpiry         = 2 * time.Hour    // Age past which no instance can still be serving a request in flight
+	logWriteMaxBatch          = 200              // Max log writes in one transaction
+	logWriteMaxDelay          = 2 * time.Second  // Max wait for room in a full log queue before dropping a write
+	logWriteQueueSize         = 1000             // Max log writes queued for the database
 	shutdownTimeout           = 10 * time.Second // Timeout for graceful shutdown
 )
 
@@ -34,26 +43,66 @@ const geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
 
 // Configuration structs
 type Config struct {
-	Host         string                    `json:"host"`
-	Port         int                       `json:"port"`
-	DatabaseFile string                    `json:"databasefile"`
-	PageSize     int                       `json:"pagesize"`
-	Providers    map[string]ProviderConfig `json:"providers"`
+	Host               string                    `json:"host"`
+	Port               int                       `json:"port"`
+	DatabaseFile       string                    `json:"databasefile"`
+	Database           string                    `json:"database"` // postgres:// URL, or sqlite://<path>; databasefile when empty
+	PageSize           int                       `json:"pagesize"`
+	AdminToken         string                    `json:"admintoken"`
+	MetadataHeaders    []string                  `json:"metadataheaders"`
+	MaxRequestCapture  int                       `json:"maxrequestcapture"`  // bytes of a request body logged
+	MaxResponseCapture int                       `json:"maxresponsecapture"` // bytes of a response body logged
+	Providers          map[string]ProviderConfig `json:"providers"`
+	Tracing            *TracingConfig            `json:"tracing"`
+	Webhooks           []WebhookConfig           `json:"webhooks"`
+}
+
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"servicename"`
+}
+
+// WebhookConfig posts completed requests matching all of the set conditions
+type WebhookConfig struct {
+	URL           string   `json:"url"`
+	Secret        string   `json:"secret"`
+	MinStatus     int      `json:"minstatus"`
+	MinDurationMs int      `json:"mindurationms"`
+	Models        []string `json:"models"`
+	MinCost       float64  `json:"mincost"`
 }
 
 type ProviderConfig struct {
-	BaseURL       string            `json:"baseurl"`
-	ApiKey        string            `json:"apikey"`
-	HeaderMapping map[string]string `json:"headermapping"`
-	Models        *[]string         `json:"models"`
-	Enabled       *bool             `json:"enabled"`
-	IsGemini      bool              `json:"-"`
+	BaseURL       string                `json:"baseurl"`
+	ApiKey        string                `json:"apikey"`
+	HeaderMapping map[string]string     `json:"headermapping"`
+	Models        *[]string             `json:"models"`
+	Prices        map[string]ModelPrice `json:"prices"`
+	Enabled       *bool                 `json:"enabled"`
+	IsGemini      bool                  `json:"-"`
+}
+
+// ModelPrice is the price in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
 }
 
 func (p *ProviderConfig) IsEnabled() bool {
 	return p.Enabled == nil || *p.Enabled
 }
 
+// Cost estimates the USD cost of a request from its token usage
+func (p *ProviderConfig) Cost(model string, usage *ChatUsage) (cost float64, ok bool) {
+	price, ok := p.Prices[model]
+	if !ok || usage == nil {
+		return 0, false
+	}
+	cost = (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+	return cost, true
+}
+
 func defaultString(value, defaultValue string) string {
 	if value == "" {
 		return defaultValue
@@ -76,6 +125,9 @@ var defaultConfig = Config{
 	Port:         defaultInt(os.Getenv("LLMSEE_PORT"), 5050),
 	DatabaseFile: "llmsee.db",
 	PageSize:     20,
+
+	MaxRequestCapture:  10 << 20,
+	MaxResponseCapture: 10 << 20,
 	Providers: map[string]ProviderConfig{
 		"ollama": {
 			BaseURL:       "http://" + defaultString(os.Getenv("LLMSEE_LOCALHOST"), "localhost") + ":11434/v1",
@@ -85,20 +137,61 @@ var defaultConfig = Config{
 	},
 }
 
-func getConfig() (config *Config, err error) {
+// ignoreInvalidConfig allows starting with an invalid config file
+var ignoreInvalidConfig bool
+
+func getConfig(configFile string) (config *Config, err error) {
+	config, err = loadConfig(configFile)
+	if err != nil {
+		if !ignoreInvalidConfig {
+			return nil, fmt.Errorf("%w\nfix the config, or start anyway with -ignore-invalid-config", err)
+		}
+		log.Printf("Ignoring invalid config: %v", err)
+		if config == nil {
+			config, _ = loadConfig("")
+		}
+	} else if configFile != "" {
+		log.Printf("Config file %s", configFile)
+	}
+
+	return config, nil
+}
+
+// loadConfig reads the config file, if any, applies the defaults and
+// environment overrides, and validates the result; a config with invalid
+// values is returned along with the error
+func loadConfig(configFile string) (config *Config, err error) {
 	config = &Config{}
-	configFile := findConfigFile()
+
+	var problems []ConfigProblem
+	var positions map[string]configPosition
 
 	if configFile != "" {
-		fileConfig, _ := os.ReadFile(configFile)
-		if err := json.Unmarshal(fileConfig, &config); err != nil {
-			log.Printf("Config file %s is not valid, skipping", configFile)
-			config = &Config{}
-		} else {
-			log.Printf("Config file %s", configFile)
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		config, problems, positions = decodeConfig(configFile, data)
+		if config == nil {
+			return nil, newConfigError(configFile, positions, problems)
 		}
 	}
 
+	// if there are no providers, assign the defaults
+	if config.Providers == nil {
+		config.Providers = make(map[string]ProviderConfig)
+		for provider, defaultProviderConfig := range defaultConfig.Providers {
+			if _, exists := config.Providers[provider]; !exists {
+				config.Providers[provider] = defaultProviderConfig
+			}
+		}
+	}
+
+	problems = append(problems, applyProviderEnv(config)...)
+	problems = append(problems, resolveConfigReferences(config)...)
+	problems = append(problems, validateConfig(config)...)
+	err = newConfigError(configFile, positions, problems)
+
 	if config.Host == "" {
 		config.Host = defaultConfig.Host
 	}
@@ -115,14 +208,12 @@ func getConfig() (config *Config, err error) {
 		config.PageSize = defaultConfig.PageSize
 	}
 
-	// if there are no providers, assign the defaults
-	if config.Providers == nil {
-		config.Providers = make(map[string]ProviderConfig)
-		for provider, defaultProviderConfig := range defaultConfig.Providers {
-			if _, exists := config.Providers[provider]; !exists {
-				config.Providers[provider] = defaultProviderConfig
-			}
-		}
+	if config.MaxRequestCapture == 0 {
+		config.MaxRequestCapture = defaultConfig.MaxRequestCapture
+	}
+
+	if config.MaxResponseCapture == 0 {
+		config.MaxResponseCapture = defaultConfig.MaxResponseCapture
 	}
 
 	// process providers
@@ -143,16 +234,21 @@ func getConfig() (config *Config, err error) {
 func findConfigFile() string {
 	// if configfile in arguments (-c <configfile>), it must exist
 	var configFile string
-	flag.StringVar(&configFile, "c", "", "Path to JSON configuration file")
+	flag.StringVar(&configFile, "c", "", "Path to configuration file (.json, .yaml, .yml or .toml)")
+	flag.BoolVar(&ignoreInvalidConfig, "ignore-invalid-config", os.Getenv("LLMSEE_IGNORE_INVALID_CONFIG") != "", "Start even if the configuration file is invalid")
 	flag.Parse()
 	if configFile != "" {
 		return configFile
 	}
 
-	// check env variable
+	// check env variable, which may point to a file that isn't mounted
 	configFile = os.Getenv("LLMSEE_CONFIGFILE")
 	if configFile != "" {
-		return configFile
+		if fileExists(configFile) {
+			return configFile
+		}
+		log.Printf("Config file %s not found, using defaults and environment", configFile)
+		return ""
 	}
 
 	// check default OS paths
@@ -160,15 +256,13 @@ func findConfigFile() string {
 	case "darwin":
 		// macOS uses ~/Library/Application Support for application data
 		userLibrary := os.Getenv("HOME") + "/Library/Application Support"
-		configFile := filepath.Join(userLibrary, defaultConfigFile)
-		if fileExists(configFile) {
+		if configFile := findConfigIn(userLibrary); configFile != "" {
 			return configFile
 		}
 
 		// Check HOME/.config (fallback for Linux/macOS)
 		if home := os.Getenv("HOME"); home != "" {
-			configFile := filepath.Join(home, ".config", defaultConfigFile)
-			if fileExists(configFile) {
+			if configFile := findConfigIn(home, ".config"); configFile != "" {
 				return configFile
 			}
 		}
@@ -176,16 +270,14 @@ func findConfigFile() string {
 	case "linux":
 		// Check XDG_CONFIG_HOME for Linux
 		if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
-			configFile := filepath.Join(xdgConfigHome, defaultConfigFile)
-			if fileExists(configFile) {
+			if configFile := findConfigIn(xdgConfigHome); configFile != "" {
 				return configFile
 			}
 		}
 
 		// Check HOME/.config (fallback for Linux/macOS)
 		if home := os.Getenv("HOME"); home != "" {
-			configFile := filepath.Join(home, ".config", defaultConfigFile)
-			if fileExists(configFile) {
+			if configFile := findConfigIn(home, ".config"); configFile != "" {
 				return configFile
 			}
 		}
@@ -193,16 +285,14 @@ func findConfigFile() string {
 	case "windows":
 		// Check APPDATA for Windows
 		if appData := os.Getenv("APPDATA"); appData != "" {
-			configFile := filepath.Join(appData, defaultConfigFile)
-			if fileExists(configFile) {
+			if configFile := findConfigIn(appData); configFile != "" {
 				return configFile
 			}
 		}
 
 		// Check HOME (Fallback for Windows)
 		if home := os.Getenv("USERPROFILE"); home != "" {
-			configFile := filepath.Join(home, defaultConfigFile)
-			if fileExists(configFile) {
+			if configFile := findConfigIn(home); configFile != "" {
 				return configFile
 			}
 		}
@@ -212,6 +302,17 @@ func findConfigFile() string {
 	return ""
 }
 
+// findConfigIn returns the first supported config file in the directory
+func findConfigIn(dir ...string) string {
+	for _, name := range configFileNames {
+		configFile := filepath.Join(append(dir, name)...)
+		if fileExists(configFile) {
+			return configFile
+		}
+	}
+	return ""
+}
+
 // fileExists checks if a given file exists.
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
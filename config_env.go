@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// providerEnvPrefix starts the LLMSEE_PROVIDER_<NAME>_<SETTING> overrides
+const providerEnvPrefix = "LLMSEE_PROVIDER_"
+
+// envReference matches ${VAR} references in config values
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// providerEnvName converts a provider name to its form in environment variables
+func providerEnvName(provider string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(provider))
+}
+
+// applyProviderEnv applies LLMSEE_PROVIDER_<NAME>_<SETTING> variables, adding
+// providers that aren't in the config file
+func applyProviderEnv(config *Config) (problems []ConfigProblem) {
+	settings := []string{"BASEURL", "APIKEY", "HEADERMAPPING", "MODELS", "ENABLED"}
+
+	env := os.Environ()
+	slices.Sort(env)
+
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(key, providerEnvPrefix)
+		if !ok {
+			continue
+		}
+
+		var envName, setting string
+		for _, s := range settings {
+			if name, found := strings.CutSuffix(rest, "_"+s); found && name != "" {
+				envName, setting = name, s
+				break
+			}
+		}
+		if setting == "" {
+			problems = append(problems, ConfigProblem{
+				Path:    key,
+				Message: fmt.Sprintf("unknown provider setting, expected %s<NAME>_ followed by one of: %s", providerEnvPrefix, strings.Join(settings, ", ")),
+			})
+			continue
+		}
+
+		// match an existing provider, or add a new one
+		provider := strings.ToLower(envName)
+		for name := range config.Providers {
+			if providerEnvName(name) == envName {
+				provider = name
+				break
+			}
+		}
+		providerConfig := config.Providers[provider]
+		path := "providers." + provider + "." + strings.ToLower(setting)
+
+		switch setting {
+		case "BASEURL":
+			providerConfig.BaseURL = value
+		case "APIKEY":
+			providerConfig.ApiKey = value
+		case "HEADERMAPPING":
+			mapping := make(map[string]string)
+			for _, pair := range strings.Split(value, ",") {
+				orig, mapped, ok := strings.Cut(pair, "=")
+				if !ok {
+					problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf("%s must be a list of From=To pairs, got %q", key, pair)})
+					continue
+				}
+				mapping[strings.TrimSpace(orig)] = strings.TrimSpace(mapped)
+			}
+			providerConfig.HeaderMapping = mapping
+		case "MODELS":
+			var models []string
+			for _, model := range strings.Split(value, ",") {
+				if model = strings.TrimSpace(model); model != "" {
+					models = append(models, model)
+				}
+			}
+			providerConfig.Models = &models
+		case "ENABLED":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf("%s must be true or false, got %q", key, value)})
+				continue
+			}
+			providerConfig.Enabled = &enabled
+		}
+
+		config.Providers[provider] = providerConfig
+	}
+
+	return problems
+}
+
+// resolveConfigReferences replaces ${VAR} and file:/path references in the
+// provider base URLs, API keys and header mappings, and the admin token
+func resolveConfigReferences(config *Config) (problems []ConfigProblem) {
+	for name, provider := range config.Providers {
+		if !provider.IsEnabled() {
+			continue
+		}
+		path := "providers." + name
+
+		resolve := func(field, value string) string {
+			resolved, err := resolveConfigValue(value)
+			if err != nil {
+				problems = append(problems, ConfigProblem{Path: path + "." + field, Message: err.Error()})
+			}
+			return resolved
+		}
+
+		provider.BaseURL = resolve("baseurl", provider.BaseURL)
+		provider.ApiKey = resolve("apikey", provider.ApiKey)
+
+		// copy so the defaults are never modified
+		provider.HeaderMapping = maps.Clone(provider.HeaderMapping)
+		for orig, mapped := range provider.HeaderMapping {
+			provider.HeaderMapping[orig] = resolve("headermapping."+orig, mapped)
+		}
+
+		config.Providers[name] = provider
+	}
+
+	adminToken, err := resolveConfigValue(config.AdminToken)
+	if err != nil {
+		problems = append(problems, ConfigProblem{Path: "admintoken", Message: err.Error()})
+	}
+	config.AdminToken = adminToken
+
+	database, err := resolveConfigValue(config.Database)
+	if err != nil {
+		problems = append(problems, ConfigProblem{Path: "database", Message: err.Error()})
+	}
+	config.Database = database
+
+	return problems
+}
+
+// resolveConfigValue reads a file:/path value, or expands ${VAR} references
+func resolveConfigValue(value string) (string, error) {
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	resolved := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// yamlErrorLine extracts the line number from a YAML error message
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// configFormat returns json, yaml or toml based on the file extension
+func configFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// decodeConfigDocument parses a config file into generic values, along with
+// the position of each key
+func decodeConfigDocument(format string, data []byte) (interface{}, map[string]configPosition, *ConfigProblem) {
+	switch format {
+	case "yaml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			p := ConfigProblem{Message: "invalid YAML: " + strings.TrimPrefix(err.Error(), "yaml: ")}
+			if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+				p.Line, _ = strconv.Atoi(m[1])
+				p.Column = 1
+			}
+			return nil, nil, &p
+		}
+
+		var raw interface{}
+		if len(doc.Content) > 0 {
+			if err := doc.Content[0].Decode(&raw); err != nil {
+				return nil, nil, &ConfigProblem{Message: "invalid YAML: " + err.Error()}
+			}
+		}
+		positions := make(map[string]configPosition)
+		yamlKeyPositions(&doc, "", positions)
+		return normalizeConfigValue(raw), positions, nil
+
+	case "toml":
+		var raw map[string]interface{}
+		if _, err := toml.Decode(string(data), &raw); err != nil {
+			p := ConfigProblem{Message: "invalid TOML: " + err.Error()}
+			var parseErr toml.ParseError
+			if errors.As(err, &parseErr) {
+				p.Message = "invalid TOML: " + parseErr.Message
+				p.Line, p.Column = parseErr.Position.Line, parseErr.Position.Col
+			}
+			return nil, nil, &p
+		}
+		return normalizeConfigValue(raw), tomlKeyPositions(data), nil
+
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var raw interface{}
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, &ConfigProblem{Message: "invalid JSON: " + err.Error()}
+		}
+		return normalizeConfigValue(raw), jsonKeyPositions(data), nil
+	}
+}
+
+// encodeConfigDocument writes generic config values in the given format
+func encodeConfigDocument(format string, raw interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(raw); err != nil {
+			return nil, err
+		}
+		enc.Close()
+	case "toml":
+		enc := toml.NewEncoder(&buf)
+		enc.Indent = ""
+		if err := enc.Encode(raw); err != nil {
+			return nil, err
+		}
+	default:
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(raw); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeConfigValue gives every format the same generic types: string keyed
+// maps, and int64 for whole numbers
+func normalizeConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeConfigValue(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeConfigValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeConfigValue(item)
+		}
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeConfigValue(item)
+		}
+		return list
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// yamlKeyPositions records the position of each key in a YAML document
+func yamlKeyPositions(node *yaml.Node, path string, positions map[string]configPosition) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlKeyPositions(child, path, positions)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := key.Value
+			if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			positions[strings.ToLower(keyPath)] = configPosition{Line: key.Line, Column: key.Column}
+			yamlKeyPositions(value, keyPath, positions)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[strings.ToLower(itemPath)] = configPosition{Line: item.Line, Column: item.Column}
+			yamlKeyPositions(item, itemPath, positions)
+		}
+	}
+}
+
+// tomlKeyPositions records the line of each table and key in a TOML file; it
+// follows [table], [[array]] and key = value lines, which covers config files
+func tomlKeyPositions(data []byte) map[string]configPosition {
+	positions := make(map[string]configPosition)
+	arrayCounts := make(map[string]int)
+	table := ""
+
+	unquote := func(key string) string {
+		var parts []string
+		for _, part := range strings.Split(key, ".") {
+			parts = append(parts, strings.Trim(strings.TrimSpace(part), `"'`))
+		}
+		return strings.Join(parts, ".")
+	}
+	join := func(prefix, key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		column := len(line) - len(strings.TrimLeft(line, " \t")) + 1
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+
+		case strings.HasPrefix(trimmed, "[["):
+			name := unquote(strings.TrimSuffix(strings.TrimPrefix(trimmed, "[["), "]]"))
+			table = fmt.Sprintf("%s[%d]", name, arrayCounts[name])
+			arrayCounts[name]++
+			positions[strings.ToLower(table)] = configPosition{Line: lineNo, Column: column}
+
+		case strings.HasPrefix(trimmed, "["):
+			table = unquote(strings.TrimSuffix(strings.TrimPrefix(trimmed, "["), "]"))
+			positions[strings.ToLower(table)] = configPosition{Line: lineNo, Column: column}
+
+		default:
+			key, _, found := strings.Cut(trimmed, "=")
+			if !found {
+				continue
+			}
+			positions[strings.ToLower(join(table, unquote(key)))] = configPosition{Line: lineNo, Column: column}
+		}
+	}
+
+	return positions
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reservedProviderNames are top-level paths served by llmsee itself
+var reservedProviderNames = []string{"ui", "log", "v1", "favicon.ico", "stats", "marker", "conversations"}
+
+// ConfigProblem is a single validation failure, located in the file where possible
+type ConfigProblem struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+// ConfigError lists every problem found in a config file
+type ConfigError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "config file %s has %d problem(s):", e.File, len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(e.File)
+		if p.Line > 0 {
+			fmt.Fprintf(&b, ":%d:%d", p.Line, p.Column)
+		}
+		b.WriteString(": ")
+		if p.Path != "" {
+			b.WriteString(p.Path + ": ")
+		}
+		b.WriteString(p.Message)
+	}
+	return b.String()
+}
+
+// configPosition is a 1-based line and column in a config file
+type configPosition struct {
+	Line   int
+	Column int
+}
+
+// decodeConfig decodes a JSON, YAML or TOML config file, reporting syntax and
+// type errors and unknown settings; the config is nil if it couldn't be
+// decoded. The positions map each lowercased key path to its location.
+func decodeConfig(file string, data []byte) (*Config, []ConfigProblem, map[string]configPosition) {
+	format := configFormat(file)
+
+	// YAML and TOML are converted to JSON so every format maps onto the same structs
+	jsonData := data
+	var positions map[string]configPosition
+	if format == "json" {
+		positions = jsonKeyPositions(data)
+	} else {
+		raw, pos, problem := decodeConfigDocument(format, data)
+		if problem != nil {
+			return nil, []ConfigProblem{*problem}, nil
+		}
+		positions = pos
+		jsonData, _ = json.Marshal(raw)
+	}
+
+	var problems []ConfigProblem
+	config := &Config{}
+
+	if err := json.Unmarshal(jsonData, config); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			p := ConfigProblem{Message: "invalid JSON: " + syntaxErr.Error()}
+			p.Line, p.Column = lineColumn(data, syntaxErr.Offset)
+			return nil, []ConfigProblem{p}, nil
+		case errors.As(err, &typeErr):
+			p := ConfigProblem{Path: typeErr.Field, Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+			if format == "json" {
+				p.Line, p.Column = lineColumn(data, typeErr.Offset)
+			}
+			problems = append(problems, p)
+			config = nil
+		default:
+			return nil, []ConfigProblem{{Message: err.Error()}}, nil
+		}
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(jsonData, &raw); err == nil {
+		problems = append(problems, unknownConfigKeys(raw, reflect.TypeOf(Config{}), "")...)
+	}
+
+	return config, problems, positions
+}
+
+// newConfigError locates the problems in the file and sorts them, returns nil
+// if there are no problems
+func newConfigError(file string, positions map[string]configPosition, problems []ConfigProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	for i := range problems {
+		if problems[i].Line == 0 {
+			if pos, ok := positions[strings.ToLower(problems[i].Path)]; ok {
+				problems[i].Line, problems[i].Column = pos.Line, pos.Column
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		if problems[i].Column != problems[j].Column {
+			return problems[i].Column < problems[j].Column
+		}
+		return problems[i].Path < problems[j].Path
+	})
+
+	return &ConfigError{File: defaultString(file, "environment"), Problems: problems}
+}
+
+// validateConfig checks the values of a decoded config
+func validateConfig(config *Config) (problems []ConfigProblem) {
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		add("port", "must be between 1 and 65535, got %d", config.Port)
+	}
+	if config.PageSize < 0 {
+		add("pagesize", "must be positive, got %d", config.PageSize)
+	}
+	if config.MaxRequestCapture < 0 {
+		add("maxrequestcapture", "must be positive, got %d", config.MaxRequestCapture)
+	}
+	if config.MaxResponseCapture < 0 {
+		add("maxresponsecapture", "must be positive, got %d", config.MaxResponseCapture)
+	}
+	if config.Database != "" && !isPostgresURL(config.Database) && !strings.HasPrefix(config.Database, "sqlite://") {
+		add("database", "must be a postgres:// or sqlite:// URL")
+	}
+
+	for name, provider := range config.Providers {
+		path := "providers." + name
+		switch {
+		case name == "":
+			add(path, "provider name must not be empty")
+		case containsFold(reservedProviderNames, name):
+			add(path, "provider name %q collides with the reserved path /%s, choose another name", name, name)
+		case strings.ContainsAny(name, "/:?#"):
+			add(path, "provider name %q must not contain '/', ':', '?' or '#'", name)
+		}
+
+		if !provider.IsEnabled() {
+			continue
+		}
+
+		if provider.BaseURL == "" {
+			add(path+".baseurl", "is required")
+		} else if msg := checkURL(provider.BaseURL); msg != "" {
+			add(path+".baseurl", "%s", msg)
+		}
+
+		for orig, mapped := range provider.HeaderMapping {
+			if orig == "" || mapped == "" {
+				add(path+".headermapping", "header names must not be empty")
+			}
+		}
+
+		for model, price := range provider.Prices {
+			if price.Input < 0 || price.Output < 0 {
+				add(path+".prices."+model, "prices must not be negative")
+			}
+		}
+	}
+
+	for i, name := range config.MetadataHeaders {
+		if metadataKey(name) == "" {
+			add(fmt.Sprintf("metadataheaders[%d]", i), "%q is not a header name", name)
+		}
+	}
+
+	if config.Tracing != nil && config.Tracing.Endpoint != "" {
+		if msg := checkURL(config.Tracing.Endpoint); msg != "" {
+			add("tracing.endpoint", "%s", msg)
+		}
+	}
+
+	for i, webhook := range config.Webhooks {
+		path := fmt.Sprintf("webhooks[%d]", i)
+		if webhook.URL == "" {
+			add(path+".url", "is required")
+		} else if msg := checkURL(webhook.URL); msg != "" {
+			add(path+".url", "%s", msg)
+		}
+		if webhook.MinStatus != 0 && (webhook.MinStatus < 100 || webhook.MinStatus > 599) {
+			add(path+".minstatus", "must be an HTTP status between 100 and 599, got %d", webhook.MinStatus)
+		}
+		if webhook.MinDurationMs < 0 {
+			add(path+".mindurationms", "must not be negative")
+		}
+		if webhook.MinCost < 0 {
+			add(path+".mincost", "must not be negative")
+		}
+	}
+
+	return problems
+}
+
+// checkURL returns a message if the value isn't an absolute http(s) URL
+func checkURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Sprintf("%q is not a valid URL: %v", value, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Sprintf("%q must start with http:// or https://", value)
+	}
+	if u.Host == "" {
+		return fmt.Sprintf("%q has no host", value)
+	}
+	return ""
+}
+
+// unknownConfigKeys reports keys that don't match a field of the target type;
+// matching is case-insensitive like encoding/json
+func unknownConfigKeys(value interface{}, t reflect.Type, path string) (problems []ConfigProblem) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		var names []string
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			fields[strings.ToLower(tag)] = t.Field(i).Type
+			names = append(names, tag)
+		}
+		for key, v := range obj {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, ConfigProblem{
+					Path:    join(key),
+					Message: fmt.Sprintf("unknown setting, expected one of: %s", strings.Join(names, ", ")),
+				})
+				continue
+			}
+			problems = append(problems, unknownConfigKeys(v, fieldType, join(key))...)
+		}
+
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, v := range obj {
+			problems = append(problems, unknownConfigKeys(v, t.Elem(), join(key))...)
+		}
+
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, v := range list {
+			problems = append(problems, unknownConfigKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+// jsonKeyPositions maps each lowercased key path to the position of its key in the file
+func jsonKeyPositions(data []byte) map[string]configPosition {
+	positions := make(map[string]configPosition)
+
+	type frame struct {
+		path    string
+		isArray bool
+		index   int
+		key     string
+		wantKey bool
+	}
+	var stack []*frame
+
+	// childPath is the path of the value about to be read in the current container
+	childPath := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		top := stack[len(stack)-1]
+		if top.isArray {
+			return fmt.Sprintf("%s[%d]", top.path, top.index)
+		}
+		if top.path == "" {
+			return top.key
+		}
+		return top.path + "." + top.key
+	}
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.isArray {
+			top.index++
+		} else {
+			top.wantKey = true
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF || err != nil {
+			return positions
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, &frame{path: childPath(), wantKey: true})
+			case '[':
+				stack = append(stack, &frame{path: childPath(), isArray: true})
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+
+		case string:
+			top := (*frame)(nil)
+			if len(stack) > 0 {
+				top = stack[len(stack)-1]
+			}
+			if top != nil && !top.isArray && top.wantKey {
+				top.key = t
+				top.wantKey = false
+				// the offset is just past the closing quote of the key
+				keyOffset := dec.InputOffset() - int64(len(t)) - 2
+				line, column := lineColumn(data, keyOffset)
+				positions[strings.ToLower(childPath())] = configPosition{Line: line, Column: column}
+				continue
+			}
+			valueDone()
+
+		default:
+			valueDone()
+		}
+	}
+}
+
+// lineColumn converts a byte offset to a 1-based line and column
+func lineColumn(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
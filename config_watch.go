@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+)
+
+const configPollInterval = 2 * time.Second // How often the config file is checked for changes
+
+// currentConfig returns the active config, which may be swapped by a reload
+func (s *ProxyServer) currentConfig() Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
+// reloadConfig re-reads the config file and swaps it in if it's valid
+func (s *ProxyServer) reloadConfig(reason string) {
+	if s.configFile == "" {
+		log.Printf("Config reload (%s) skipped, no config file in use", reason)
+		return
+	}
+
+	config, err := loadConfig(s.configFile)
+	if err != nil {
+		log.Printf("Config reload (%s) failed, keeping current config: %v", reason, err)
+		s.sendSSEUpdate(ServerUpdate{EventType: "config", Message: fmt.Sprintf("Config reload failed: %v", err)})
+		return
+	}
+
+	s.configMu.Lock()
+	previous := s.config
+
+	// listener, database and tracing are only read at startup
+	if config.Host != previous.Host || config.Port != previous.Port {
+		log.Printf("Config reload: host and port changes require a restart")
+	}
+	if config.DatabaseFile != previous.DatabaseFile || config.Database != previous.Database {
+		log.Printf("Config reload: databasefile and database changes require a restart")
+	}
+	if !reflect.DeepEqual(config.Tracing, previous.Tracing) {
+		log.Printf("Config reload: tracing changes require a restart")
+	}
+	config.Host = previous.Host
+	config.Port = previous.Port
+	config.DatabaseFile = previous.DatabaseFile
+	config.Database = previous.Database
+	config.Tracing = previous.Tracing
+
+	s.config = *config
+	s.configMu.Unlock()
+
+	if err := s.store.IndexMetadata(config.MetadataHeaders); err != nil {
+		log.Printf("Config reload: failed to index metadata: %v", err)
+	}
+
+	// providers may have changed, so refetch the models
+	modelDataMutex.Lock()
+	globalModelJSON = nil
+	modelDataMutex.Unlock()
+
+	log.Printf("Config reloaded (%s) from %s, %d providers", reason, s.configFile, len(config.Providers))
+	s.sendSSEUpdate(ServerUpdate{EventType: "config", Message: fmt.Sprintf("Config reloaded, %d providers", len(config.Providers))})
+}
+
+// watchConfig polls the config file and reloads it when it changes
+func (s *ProxyServer) watchConfig(ctx context.Context) {
+	if s.configFile == "" {
+		return
+	}
+
+	lastMod, lastSize := configFileState(s.configFile)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := configFileState(s.configFile)
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			s.reloadConfig("file changed")
+		}
+	}
+}
+
+// configFileState returns the modification time and size used to detect changes
+func configFileState(path string) (time.Time, int64) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return fi.ModTime(), fi.Size()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	conversationHeader      = "X-Llmsee-Session" // Names the conversation of a request explicitly
+	conversationMaxPrefixes = 500                // Longest prefixes looked up when threading a request
+	conversationBackfill    = 200                // Rows threaded per batch when backfilling
+)
+
+// messagePrefixHashes returns a chained hash for every prefix of the
+// messages, the hash at index k covering the first k+1 messages
+func messagePrefixHashes(messages []ChatMessage) []string {
+	hashes := make([]string, len(messages))
+	previous := ""
+	for i, message := range messages {
+		// marshalling compacts the content, so formatting doesn't matter
+		data, _ := json.Marshal(message)
+		sum := sha256.Sum256(append([]byte(previous), data...))
+		previous = hex.EncodeToString(sum[:])
+		hashes[i] = previous
+	}
+	return hashes
+}
+
+// requestSession returns the X-Llmsee-Session header from logged request headers
+func requestSession(requestHeaders string) string {
+	var headers http.Header
+	if json.Unmarshal([]byte(requestHeaders), &headers) != nil {
+		return ""
+	}
+	return strings.TrimSpace(headers.Get(conversationHeader))
+}
+
+// threadConversation assigns a new entry to a conversation. An explicit
+// session header wins; otherwise a chat request continues the latest
+// conversation whose request its messages extend, or starts a new one.
+// Requests threaded but not stored yet are looked up in unwritten, by
+// messages hash.
+func threadConversation(store Storage, entry *LogEntry, unwritten map[string]string) error {
+	request, ok := parseChatRequest(entry.RequestBody)
+	if !ok {
+		entry.MessagesHash = ""
+		if entry.ConversationId == "" {
+			entry.ConversationId = requestSession(entry.RequestHeaders)
+		}
+		return nil
+	}
+
+	hashes := messagePrefixHashes(request.Messages)
+	entry.MessagesHash = hashes[len(hashes)-1]
+
+	if entry.ConversationId == "" {
+		entry.ConversationId = requestSession(entry.RequestHeaders)
+	}
+	if entry.ConversationId != "" {
+		return nil
+	}
+
+	// only prefixes past the system prompt say anything about the conversation,
+	// and a request repeating another one exactly starts a conversation of its own
+	first := 0
+	for first < len(request.Messages) && request.Messages[first].Role == "system" {
+		first++
+	}
+	candidates := hashes[min(first, len(hashes)-1) : len(hashes)-1]
+	if len(candidates) > conversationMaxPrefixes {
+		candidates = candidates[len(candidates)-conversationMaxPrefixes:]
+	}
+
+	if len(candidates) > 0 {
+		conversations, err := store.LatestConversations(candidates)
+		if err != nil {
+			return err
+		}
+
+		// the longest matching prefix wins
+		best := 0
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if conversationId, ok := conversations[candidates[i]]; ok {
+				best = i + 1
+				entry.ConversationId = conversationId
+				break
+			}
+		}
+
+		// requests not written yet aren't in the database, and are newer
+		for i := len(candidates) - 1; i >= 0 && i+1 >= best; i-- {
+			if conversationId, ok := unwritten[candidates[i]]; ok {
+				entry.ConversationId = conversationId
+				break
+			}
+		}
+	}
+
+	if entry.ConversationId == "" {
+		entry.ConversationId = uuid.New().String()
+	}
+	return nil
+}
+
+func (st *sqlStorage) LatestConversations(messagesHashes []string) (map[string]string, error) {
+	args := make([]interface{}, len(messagesHashes))
+	for i, hash := range messagesHashes {
+		args[i] = hash
+	}
+	rows, err := st.db.Query(`
+		SELECT messages_hash, conversation_id
+		FROM logs
+		WHERE conversation_id != '' AND messages_hash IN (?`+strings.Repeat(", ?", len(messagesHashes)-1)+`)
+		ORDER BY id DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := make(map[string]string)
+	for rows.Next() {
+		var hash, conversationId string
+		if err := rows.Scan(&hash, &conversationId); err != nil {
+			return nil, err
+		}
+		if _, ok := conversations[hash]; !ok {
+			conversations[hash] = conversationId
+		}
+	}
+	return conversations, rows.Err()
+}
+
+func (st *sqlStorage) UnthreadedLogs(limit int) ([]LogEntry, error) {
+	rows, err := st.db.Query(`
+		SELECT id, `+payloadColumn("request_headers")+`, `+payloadColumn("request_body")+`
+		FROM logs
+		WHERE messages_hash IS NULL
+		ORDER BY id ASC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LogEntry
+	for rows.Next() {
+		var entry LogEntry
+		payloads, decodePayloads := payloadScan(&entry.RequestHeaders, &entry.RequestBody)
+		err := rows.Scan(append([]any{&entry.Id}, payloads...)...)
+		if err == nil {
+			err = decodePayloads()
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (st *sqlStorage) SetConversation(entry LogEntry) error {
+	_, err := st.db.Exec(`UPDATE logs SET conversation_id = ?, messages_hash = ? WHERE id = ?`,
+		entry.ConversationId, entry.MessagesHash, entry.Id)
+	return err
+}
+
+// backfillConversations threads the rows logged before conversations were tracked
+func (s *ProxyServer) backfillConversations() error {
+	threaded := 0
+	for {
+		entries, err := s.store.UnthreadedLogs(conversationBackfill)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		// rows are threaded one at a time, so each can continue the ones before it
+		for _, entry := range entries {
+			if err := threadConversation(s.store, &entry, nil); err != nil {
+				return err
+			}
+			if err := s.store.SetConversation(entry); err != nil {
+				return err
+			}
+		}
+		threaded += len(entries)
+	}
+
+	if threaded > 0 {
+		log.Printf("Threaded %d earlier request(s) into conversations", threaded)
+	}
+	return nil
+}
+
+// ConversationTurn is one request of a conversation, with only the messages
+// it added to the previous turn
+type ConversationTurn struct {
+	Id             int64         `json:"id"`
+	Timestamp      string        `json:"timestamp"`
+	Provider       string        `json:"provider"`
+	Model          string        `json:"model"`
+	ResponseStatus int           `json:"response_status"`
+	DurationMs     int           `json:"duration_ms"`
+	State          string        `json:"state"`
+	Error          string        `json:"error,omitempty"`
+	Messages       []ChatMessage `json:"messages"`
+	Response       *ChatMessage  `json:"response,omitempty"`
+	FinishReason   string        `json:"finish_reason,omitempty"`
+	Usage          *ChatUsage    `json:"usage,omitempty"`
+}
+
+// conversationTurns reads the turns of a conversation, oldest first
+func (s *ProxyServer) conversationTurns(conversationId string) ([]ConversationTurn, error) {
+	turns := []ConversationTurn{}
+	var previous []string // message prefix hashes of the previous turn
+	answered := false
+	err := s.store.SearchLogs(LogFilter{Conversation: conversationId}, func(entry LogEntry) error {
+		turn := ConversationTurn{
+			Id:             entry.Id,
+			Timestamp:      entry.Timestamp,
+			Provider:       entry.Provider,
+			Model:          entry.Model,
+			ResponseStatus: entry.ResponseStatus,
+			DurationMs:     entry.DurationMs,
+			State:          entry.State,
+			Error:          entry.Error,
+			Messages:       []ChatMessage{},
+		}
+
+		request, _ := parseChatRequest(entry.RequestBody)
+		hashes := messagePrefixHashes(request.Messages)
+		messages := request.Messages
+
+		// a turn extending the previous one only shows what's new, leaving out
+		// the echo of the previous response
+		if n := len(previous); n > 0 && len(hashes) > n && hashes[n-1] == previous[n-1] {
+			messages = messages[n:]
+			if answered && len(messages) > 0 && messages[0].Role == "assistant" {
+				messages = messages[1:]
+			}
+		}
+		turn.Messages = append(turn.Messages, messages...)
+
+		response, ok := parseChatResponse(entry.ResponseBody)
+		if ok {
+			turn.Response = &response.Message
+			turn.FinishReason = response.FinishReason
+			turn.Usage = response.Usage
+		}
+
+		turns = append(turns, turn)
+		previous, answered = hashes, ok
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading log: %w", err)
+	}
+	return turns, nil
+}
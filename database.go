@@ -5,41 +5,295 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type LogEntry struct {
-	Id               int64  `json:"id"`
-	Timestamp        string `json:"timestamp"`
-	Provider         string `json:"provider"`
-	Method           string `json:"method"`
-	Model            string `json:"model"`
-	TargetURL        string `json:"target_url"`
-	RequestHeaders   string `json:"request_headers"`
-	RequestBody      string `json:"request_body"`
-	RequestBodySize  int    `json:"request_body_size"`
-	ResponseStatus   int    `json:"response_status"`
-	ResponseHeaders  string `json:"response_headers"`
-	ResponseBody     string `json:"response_body"`
-	ResponseBodySize int    `json:"response_body_size"`
-	UserAgent        string `json:"useragent"`
-	DurationMs       int    `json:"duration_ms"`
+	Id               int64             `json:"id"`
+	Timestamp        string            `json:"timestamp"`
+	Provider         string            `json:"provider"`
+	Method           string            `json:"method"`
+	Model            string            `json:"model"`
+	TargetURL        string            `json:"target_url"`
+	RequestHeaders   string            `json:"request_headers"`
+	RequestBody      string            `json:"request_body"`
+	RequestBodySize  int               `json:"request_body_size"`
+	ResponseStatus   int               `json:"response_status"`
+	ResponseHeaders  string            `json:"response_headers"`
+	ResponseBody     string            `json:"response_body"`
+	ResponseBodySize int               `json:"response_body_size"`
+	UserAgent        string            `json:"useragent"`
+	DurationMs       int               `json:"duration_ms"`
+	State            string            `json:"state"`
+	Error            string            `json:"error,omitempty"`
+	ConversationId   string            `json:"conversation_id,omitempty"`
+	MessagesHash     string            `json:"-"`
+	Tags             []string          `json:"tags,omitempty"`
+	Note             string            `json:"note,omitempty"`
+	Starred          bool              `json:"starred,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
 }
 
+// States of a log row; every request ends in one of the states after in_flight
+const (
+	logStateInFlight        = "in_flight"
+	logStateCompleted       = "completed"
+	logStateClientCancelled = "client_cancelled"
+	logStateCancelled       = "cancelled" // cancelled from the UI or /log/cancel
+	logStateUpstreamError   = "upstream_error"
+	logStateTimeout         = "timeout"
+	logStateTruncated       = "truncated"
+	logStateInterrupted     = "interrupted" // llmsee stopped before the request finished
+)
+
 type LogResponse struct {
 	Logs        []LogEntry `json:"logs"`
+	Markers     []Marker   `json:"markers"`
 	TotalPages  int        `json:"totalPages"`
 	CurrentPage int        `json:"currentPage"`
 	TotalLogs   int        `json:"totalLogs"`
 }
 
-func getDb(dbPath string) (db *sql.DB, err error) {
+// LogFilter narrows the rows returned by the list and export APIs
+type LogFilter struct {
+	Provider     string
+	Model        string
+	Status       int
+	From         string
+	To           string
+	Conversation string
+	Tag          string
+	Starred      bool
+	FromMarker   string // requests after this marker, by name or id
+	ToMarker     string // requests before this marker
+	Metadata     map[string]string
+
+	// places of FromMarker and ToMarker in write order, set by resolveLogFilter
+	fromLogSeq, toLogSeq int64
+}
+
+// parseLogFilter reads the filter from the query string; metadata is
+// matched with meta.<key>=<value>
+func parseLogFilter(query url.Values) LogFilter {
+	status, _ := strconv.Atoi(query.Get("status"))
+	var metadata map[string]string
+	for param := range query {
+		if key, ok := strings.CutPrefix(param, "meta."); ok {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[key] = query.Get(param)
+		}
+	}
+	return LogFilter{
+		Provider:     query.Get("provider"),
+		Model:        query.Get("model"),
+		Status:       status,
+		From:         query.Get("from"),
+		To:           query.Get("to"),
+		Conversation: query.Get("conversation"),
+		Tag:          query.Get("tag"),
+		Starred:      query.Get("starred") == "true",
+		FromMarker:   query.Get("from_marker"),
+		ToMarker:     query.Get("to_marker"),
+		Metadata:     metadata,
+	}
+}
+
+// where builds the SQL WHERE clause and its arguments for the filter
+func (f LogFilter) where(db *DB) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if f.Provider != "" {
+		conds = append(conds, "provider = ?")
+		args = append(args, f.Provider)
+	}
+	if f.Model != "" {
+		conds = append(conds, "model = ?")
+		args = append(args, f.Model)
+	}
+	if f.Status != 0 {
+		conds = append(conds, "response_status = ?")
+		args = append(args, f.Status)
+	}
+	if f.From != "" {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		conds = append(conds, "timestamp <= ?")
+		args = append(args, f.To)
+	}
+	if f.Conversation != "" {
+		conds = append(conds, "conversation_id = ?")
+		args = append(args, f.Conversation)
+	}
+	if f.Tag != "" {
+		conds = append(conds, "logs.id IN (SELECT log_id FROM log_annotations WHERE "+db.tagged("tags")+")")
+		args = append(args, f.Tag)
+	}
+	if f.Starred {
+		conds = append(conds, "logs.id IN (SELECT log_id FROM log_annotations WHERE starred = 1)")
+	}
+	if f.FromMarker != "" {
+		conds = append(conds, "logs.seq > ?")
+		args = append(args, f.fromLogSeq)
+	}
+	if f.ToMarker != "" {
+		conds = append(conds, "logs.seq <= ?")
+		args = append(args, f.toLogSeq)
+	}
+	keys := make([]string, 0, len(f.Metadata))
+	for key := range f.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conds = append(conds, db.metadataExpr(key)+" = ?")
+		args = append(args, f.Metadata[key])
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// DB is the database behind the storage, SQLite or PostgreSQL. Queries are
+// written with ? placeholders, rewritten to $n for PostgreSQL; the dialect
+// methods below cover the few expressions that differ.
+type DB struct {
+	*sql.DB
+	postgres bool
+}
+
+// Tx is a transaction on a DB
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+// sqlExecer is satisfied by both *DB and *Tx
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	return &Tx{Tx: tx, db: db}, err
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.rebind(query), args...)
+}
+
+// rebind numbers the ? placeholders outside string literals for PostgreSQL
+func (db *DB) rebind(query string) string {
+	if !db.postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n, quoted := 0, false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// metadataExpr is the SQL reading a metadata key; keys only contain
+// [a-z0-9_-], so the key can be inlined and match the expression indexes
+func (db *DB) metadataExpr(key string) string {
+	if db.postgres {
+		return fmt.Sprintf(`((metadata::jsonb) ->> '%s')`, metadataKey(key))
+	}
+	return fmt.Sprintf(`json_extract(metadata, '$."%s"')`, metadataKey(key))
+}
+
+// tagged is the SQL condition that a JSON array column contains the value
+// of the next placeholder
+func (db *DB) tagged(column string) string {
+	if db.postgres {
+		return fmt.Sprintf(`(%s::jsonb) @> jsonb_build_array(?::text)`, column)
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM json_each(%s) WHERE value = ?)`, column)
+}
+
+// groupConcat is the SQL joining the values of an aggregate with commas
+func (db *DB) groupConcat(expr string) string {
+	if db.postgres {
+		return fmt.Sprintf(`string_agg(%s, ',')`, expr)
+	}
+	return fmt.Sprintf(`GROUP_CONCAT(%s)`, expr)
+}
+
+// nextLogSeq is the SQL for the write order of a new logs row. SQLite write
+// transactions are serialized, so the next number is taken from the table;
+// PostgreSQL instances share a sequence.
+func (db *DB) nextLogSeq() string {
+	if db.postgres {
+		return `nextval('logs_seq')`
+	}
+	return `(SELECT COALESCE(MAX(seq), 0) + 1 FROM logs)`
+}
+
+// openDatabase opens the configured database: PostgreSQL for a postgres://
+// database URL, otherwise SQLite
+func openDatabase(config *Config) (*DB, error) {
+	if isPostgresURL(config.Database) {
+		return openPostgres(config.Database)
+	}
+	path := config.DatabaseFile
+	if file, ok := strings.CutPrefix(config.Database, "sqlite://"); ok {
+		path = file
+	}
+	return openSQLite(path)
+}
+
+// openSQLite opens or creates a SQLite database file
+func openSQLite(dbPath string) (*DB, error) {
 	log.Printf("Database file %s", dbPath)
 
-	db, err = sql.Open("sqlite", dbPath)
+	// the log writer and other writers wait for each other instead of
+	// failing with SQLITE_BUSY
+	sqlDB, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
+	db := &DB{DB: sqlDB}
 
 	// Configure connection pooling
 	db.SetMaxOpenConns(dbMaxOpenConns)
@@ -53,105 +307,102 @@ func getDb(dbPath string) (db *sql.DB, err error) {
 		return nil, fmt.Errorf("database connection failed: %w", err)
 	}
 
-	if err := initializeDatabase(db); err != nil {
-		return nil, fmt.Errorf("creating log table: %w", err)
+	if err := initializeDatabase(db, dbPath); err != nil {
+		return nil, fmt.Errorf("initializing database: %w", err)
 	}
 
 	return db, nil
 }
 
-// initializeDatabase sets up the logs table and indexes
-func initializeDatabase(db *sql.DB) error {
+// initializeDatabase configures the connection and brings the schema up to
+// date, backing up an existing database before migrating it
+func initializeDatabase(db *DB, dbPath string) error {
 	_, err := db.Exec(`
 		PRAGMA journal_mode = WAL;
 		PRAGMA synchronous = normal;
 		PRAGMA temp_store = memory;
-
-		CREATE TABLE IF NOT EXISTS logs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			timestamp TEXT NOT NULL,
-			provider TEXT NOT NULL,
-			method TEXT NOT NULL,
-			model TEXT NOT NULL,
-			target_url TEXT NOT NULL,
-			request_headers TEXT NOT NULL DEFAULT '',
-			request_body TEXT NOT NULL DEFAULT '',
-			response_status INT NOT NULL DEFAULT -1,
-			response_headers TEXT NOT NULL DEFAULT '',
-			response_body TEXT NOT NULL DEFAULT '',
-			useragent TEXT NOT NULL DEFAULT '',
-			duration_ms INTEGER NOT NULL DEFAULT -1
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_timestamp ON logs(timestamp);
 	`)
-	return err
-}
-
-// insertLogRequest stores the request logs into the database
-func (s *ProxyServer) insertLogRequest(entry LogEntry) (id int64, err error) {
-	result, err := s.db.Exec(`
-		INSERT INTO logs (
-			timestamp,
-			provider,
-			method,
-			model,
-			target_url,
-			request_headers,
-			request_body,
-			response_headers,
-			response_body,
-			useragent
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`,
-		entry.Timestamp,
-		entry.Provider,
-		entry.Method,
-		entry.Model,
-		entry.TargetURL,
-		entry.RequestHeaders,
-		entry.RequestBody,
-		entry.ResponseHeaders,
-		entry.ResponseBody,
-		entry.UserAgent,
-	)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	return migrateDatabase(db, dbPath)
+}
 
-	id, err = result.LastInsertId()
+// markInterruptedRequests closes out rows left in flight by a previous run.
+// Other instances may still be serving theirs from a PostgreSQL database, so
+// there only rows older than logInFlightExpiry are closed out.
+func (s *ProxyServer) markInterruptedRequests() error {
+	startedBefore := time.Now()
+	if isPostgresURL(s.currentConfig().Database) {
+		startedBefore = startedBefore.Add(-logInFlightExpiry)
+	}
+	n, err := s.store.MarkInterrupted(startedBefore)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if n > 0 {
+		log.Printf("Marked %d unfinished request(s) from a previous run as interrupted", n)
 	}
+	return nil
+}
 
-	entry.Id = id
+// expireInFlightRequests keeps closing out the rows that instances sharing a
+// PostgreSQL database left in flight when they stopped
+func (s *ProxyServer) expireInFlightRequests(ctx context.Context) {
+	if !isPostgresURL(s.currentConfig().Database) {
+		return
+	}
+
+	ticker := time.NewTicker(logInFlightCheck)
+	defer ticker.Stop()
 
-	log.Printf("[ID:%d] %s %s %s %d bytes sent", id, entry.Provider, entry.Method, entry.TargetURL, entry.RequestBodySize)
-	s.sendSSEUpdate(ServerUpdate{EventType: "insert", Entry: entry})
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.markInterruptedRequests(); err != nil {
+				log.Printf("failed to mark unfinished requests: %v", err)
+			}
+		}
+	}
+}
 
-	return id, nil
+// insertLogRequest queues the request logs for the database, setting the id
+// of the entry
+func (s *ProxyServer) insertLogRequest(entry *LogEntry) error {
+	return s.queueLogInsert(entry, "")
 }
 
-// updateLogRequest updates the log entry with response details and duration
-func (s *ProxyServer) updateLogRequest(entry LogEntry) error {
-	_, err := s.db.Exec(`
-		UPDATE logs SET
-			response_status = ?,
-			response_headers = ?,
-			response_body = ?,
-			duration_ms = ?
-		WHERE id = ?`,
-		entry.ResponseStatus,
-		entry.ResponseHeaders,
-		entry.ResponseBody,
-		entry.DurationMs,
-		entry.Id,
-	)
+// queueLogInsert gives the entry an id and queues it for the log writer,
+// which threads it into a conversation. An imported entry comes with its
+// content hash, and isn't dropped when the queue is full.
+func (s *ProxyServer) queueLogInsert(entry *LogEntry, importHash string) error {
+	id, err := s.writer.nextId()
 	if err != nil {
 		return err
 	}
+	entry.Id = id
+	s.writer.insert(*entry, importHash)
+
+	log.Printf("[ID:%d] %s %s %s %d bytes sent", entry.Id, entry.Provider, entry.Method, entry.TargetURL, entry.RequestBodySize)
+	s.sendSSEUpdate(ServerUpdate{EventType: "insert", Entry: *entry})
 
-	log.Printf("[ID:%d] %s (%d) %d bytes received in %dms", entry.Id, entry.Provider, entry.ResponseStatus, entry.ResponseBodySize, entry.DurationMs)
-	s.sendSSEUpdate(ServerUpdate{EventType: "update", Entry: entry})
+	return nil
+}
+
+// updateLogRequest queues the response details and duration of the log entry
+func (s *ProxyServer) updateLogRequest(entry LogEntry) error {
+	s.writer.update(entry)
+
+	if entry.State == logStateCompleted {
+		log.Printf("[ID:%d] %s (%d) %d bytes received in %dms", entry.Id, entry.Provider, entry.ResponseStatus, entry.ResponseBodySize, entry.DurationMs)
+	} else {
+		log.Printf("[ID:%d] %s %s after %dms, %d bytes received: %s", entry.Id, entry.Provider, entry.State, entry.DurationMs, entry.ResponseBodySize, entry.Error)
+	}
+	update := ServerUpdate{EventType: "update", Entry: entry}
+	s.sendSSEUpdate(update)
+	config := s.currentConfig()
+	s.notifier.Notify(update, config.Webhooks, config.Providers[entry.Provider])
 	return nil
 }
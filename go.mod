@@ -3,10 +3,13 @@ module llmsee
 go 1.24.2
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/andybalholm/brotli v1.1.1
 	github.com/golang/snappy v1.0.0
 	github.com/google/uuid v1.6.0
 	github.com/klauspost/compress v1.18.0
+	github.com/lib/pq v1.12.3
+	go.yaml.in/yaml/v3 v3.0.5
 	modernc.org/sqlite v1.37.0
 )
 
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagsHeader labels proxied requests with comma separated tags
+const tagsHeader = "X-Llmsee-Tags"
+
+// annotationColumns read the annotation of each row in a query over logs,
+// scanned with scanAnnotation
+const annotationColumns = `
+	COALESCE((SELECT tags FROM log_annotations WHERE log_id = logs.id), '[]'),
+	COALESCE((SELECT note FROM log_annotations WHERE log_id = logs.id), ''),
+	COALESCE((SELECT starred FROM log_annotations WHERE log_id = logs.id), 0)`
+
+// Annotation holds the tags, note and star of a log entry
+type Annotation struct {
+	LogId   int64    `json:"log_id"`
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
+	Starred bool     `json:"starred"`
+	Updated string   `json:"updated,omitempty"`
+}
+
+// annotationUpdate changes the fields that are set
+type annotationUpdate struct {
+	Tags    *[]string `json:"tags"`
+	Note    *string   `json:"note"`
+	Starred *bool     `json:"starred"`
+}
+
+// scanAnnotation returns the destinations for annotationColumns, and a
+// function that decodes them into the entry once scanned
+func scanAnnotation(entry *LogEntry) (dest []any, decode func()) {
+	var tags string
+	return []any{&tags, &entry.Note, &entry.Starred}, func() {
+		entry.Tags = nil
+		json.Unmarshal([]byte(tags), &entry.Tags)
+	}
+}
+
+// parseTags splits a comma separated list of tags
+func parseTags(value string) []string {
+	return normalizeTags(strings.Split(value, ","))
+}
+
+// normalizeTags trims tags and drops empty and repeated ones
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+func (st *sqlStorage) GetAnnotation(id int64) (Annotation, error) {
+	annotation := Annotation{LogId: id, Tags: []string{}}
+	var tags string
+	err := st.db.QueryRow(`SELECT tags, note, starred, updated FROM log_annotations WHERE log_id = ?`, id).
+		Scan(&tags, &annotation.Note, &annotation.Starred, &annotation.Updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return annotation, nil
+	}
+	if err != nil {
+		return annotation, err
+	}
+	json.Unmarshal([]byte(tags), &annotation.Tags)
+	return annotation, nil
+}
+
+func (st *sqlStorage) SaveAnnotation(annotation Annotation) error {
+	return storeAnnotation(st.db, annotation)
+}
+
+// storeAnnotation is SaveAnnotation on a database or a transaction
+func storeAnnotation(db sqlExecer, annotation Annotation) error {
+	annotation.Tags = normalizeTags(annotation.Tags)
+	if len(annotation.Tags) == 0 && annotation.Note == "" && !annotation.Starred {
+		_, err := db.Exec(`DELETE FROM log_annotations WHERE log_id = ?`, annotation.LogId)
+		return err
+	}
+
+	tags, _ := json.Marshal(annotation.Tags)
+	starred := 0
+	if annotation.Starred {
+		starred = 1
+	}
+	_, err := db.Exec(`
+		INSERT INTO log_annotations (log_id, tags, note, starred, updated)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(log_id) DO UPDATE SET
+			tags = excluded.tags,
+			note = excluded.note,
+			starred = excluded.starred,
+			updated = excluded.updated`,
+		annotation.LogId, string(tags), annotation.Note, starred, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// handleLogAnnotation reads (GET), updates (POST) or removes (DELETE) the
+// tags, note and star of a log entry; a POST changes only the fields sent
+func (s *ProxyServer) handleLogAnnotation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id < 0 {
+		http.Error(w, `{"error":"Invalid log ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	exists, err := s.store.HasLog(id)
+	if err == nil && !exists {
+		// a request just logged may still be queued, and its annotation with it
+		s.writer.Flush()
+		exists, err = s.store.HasLog(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, `{"error":"Log not found"}`, http.StatusNotFound)
+		return
+	}
+
+	annotation, err := s.store.GetAnnotation(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "GET" {
+		var update annotationUpdate
+		if r.Method == "POST" {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxRequestBodySize)).Decode(&update); err != nil {
+				http.Error(w, `{"error":"Invalid annotation"}`, http.StatusBadRequest)
+				return
+			}
+		} else {
+			update = annotationUpdate{Tags: &[]string{}, Note: new(string), Starred: new(bool)}
+		}
+		if update.Tags != nil {
+			annotation.Tags = *update.Tags
+		}
+		if update.Note != nil {
+			annotation.Note = *update.Note
+		}
+		if update.Starred != nil {
+			annotation.Starred = *update.Starred
+		}
+
+		if err := s.store.SaveAnnotation(annotation); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if annotation, err = s.store.GetAnnotation(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.sendSSEUpdate(ServerUpdate{EventType: "annotation", Entry: LogEntry{
+			Id:      id,
+			Tags:    annotation.Tags,
+			Note:    annotation.Note,
+			Starred: annotation.Starred,
+		}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotation)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ConversationSummary is one conversation in the /conversations list
+type ConversationSummary struct {
+	Id         string   `json:"id"`
+	Title      string   `json:"title"`
+	Started    string   `json:"started"`
+	Updated    string   `json:"updated"`
+	Turns      int      `json:"turns"`
+	Models     []string `json:"models"`
+	DurationMs int      `json:"duration_ms"`
+}
+
+type ConversationListResponse struct {
+	Conversations      []ConversationSummary `json:"conversations"`
+	TotalPages         int                   `json:"totalPages"`
+	CurrentPage        int                   `json:"currentPage"`
+	TotalConversations int                   `json:"totalConversations"`
+}
+
+type ConversationResponse struct {
+	Id    string             `json:"id"`
+	Turns []ConversationTurn `json:"turns"`
+}
+
+// handleConversationList serves the conversations, most recently active
+// first, accepting the same filters as /log
+func (s *ProxyServer) handleConversationList(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.requestLogFilter(w, r)
+	if !ok {
+		return
+	}
+	total, err := s.store.CountConversations(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	perPage := s.currentConfig().PageSize
+	totalPages := max(1, int(math.Ceil(float64(total)/float64(perPage))))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	page = min(page, totalPages)
+
+	conversations, err := s.store.ListConversations(filter, perPage, (page-1)*perPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConversationListResponse{
+		Conversations:      conversations,
+		TotalPages:         totalPages,
+		CurrentPage:        page,
+		TotalConversations: total,
+	})
+}
+
+// conversationsWhere is the WHERE clause of the threaded requests matching a filter
+func conversationsWhere(db *DB, filter LogFilter) (string, []interface{}) {
+	where, args := filter.where(db)
+	if where == "" {
+		return "WHERE conversation_id != ''", args
+	}
+	return where + " AND conversation_id != ''", args
+}
+
+func (st *sqlStorage) CountConversations(filter LogFilter) (int, error) {
+	where, args := conversationsWhere(st.db, filter)
+	var total int
+	err := st.db.QueryRow("SELECT COUNT(DISTINCT conversation_id) FROM logs "+where, args...).Scan(&total)
+	return total, err
+}
+
+func (st *sqlStorage) ListConversations(filter LogFilter, limit, offset int) ([]ConversationSummary, error) {
+	where, args := conversationsWhere(st.db, filter)
+	rows, err := st.db.Query(`
+		SELECT
+			conversation_id,
+			MIN(id),
+			MIN(timestamp),
+			MAX(timestamp),
+			COUNT(*),
+			`+st.db.groupConcat("DISTINCT model")+`,
+			SUM(CASE WHEN duration_ms > 0 THEN duration_ms ELSE 0 END)
+		FROM logs
+		`+where+`
+		GROUP BY conversation_id
+		ORDER BY MAX(id) DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []ConversationSummary{}
+	var firstIds []int64
+	for rows.Next() {
+		var c ConversationSummary
+		var firstId int64
+		var models string
+		if err := rows.Scan(&c.Id, &firstId, &c.Started, &c.Updated, &c.Turns, &models, &c.DurationMs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Models = strings.Split(models, ",")
+		conversations = append(conversations, c)
+		firstIds = append(firstIds, firstId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(firstIds) == 0 {
+		return conversations, nil
+	}
+
+	// conversations are titled by the first user message
+	args = make([]interface{}, len(firstIds))
+	for i, id := range firstIds {
+		args[i] = id
+	}
+	rows, err = st.db.Query(`
+		SELECT id, `+payloadColumn("request_body")+`
+		FROM logs
+		WHERE id IN (?`+strings.Repeat(", ?", len(firstIds)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	titles := make(map[int64]string, len(firstIds))
+	for rows.Next() {
+		var id int64
+		var body string
+		dest, decode := payloadScan(&body)
+		if err := rows.Scan(append([]any{&id}, dest...)...); err != nil {
+			return nil, err
+		}
+		if err := decode(); err != nil {
+			continue
+		}
+		request, _ := parseChatRequest(body)
+		for _, message := range request.Messages {
+			if message.Role == "user" {
+				titles[id] = truncate(strings.Join(strings.Fields(message.Text()), " "), 100)
+				break
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, id := range firstIds {
+		conversations[i].Title = titles[id]
+	}
+	return conversations, nil
+}
+
+// handleConversationDetail serves the ordered turns of a conversation
+func (s *ProxyServer) handleConversationDetail(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, `{"error":"Invalid conversation ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	turns, err := s.conversationTurns(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(turns) == 0 {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConversationResponse{Id: id, Turns: turns})
+}
+
+// handleConversationTrace serves the tool-calling loop of a conversation as a
+// tree of model calls and the tool calls they made
+func (s *ProxyServer) handleConversationTrace(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, `{"error":"Invalid conversation ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	turns, err := s.conversationTurns(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(turns) == 0 {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildAgentTrace(id, turns))
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARTimings struct {
+	Send    int `json:"send"`
+	Wait    int `json:"wait"`
+	Receive int `json:"receive"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int         `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// FineTuneExample is one line of an OpenAI chat fine-tuning dataset
+type FineTuneExample struct {
+	Messages []ChatMessage     `json:"messages"`
+	Tools    []json.RawMessage `json:"tools,omitempty"`
+}
+
+// redactionMarkers flag bodies that had sensitive content removed
+var redactionMarkers = []string{"[redacted]", "<redacted>", "***redacted***"}
+
+var csvExportColumns = []string{
+	"id",
+	"timestamp",
+	"provider",
+	"method",
+	"model",
+	"target_url",
+	"request_headers",
+	"request_body",
+	"response_status",
+	"response_headers",
+	"response_body",
+	"useragent",
+	"duration_ms",
+	"state",
+	"error",
+}
+
+// logExporter writes log entries in one of the export formats
+type logExporter struct {
+	contentType string
+	extension   string
+	start       func() error
+	writeEntry  func(LogEntry) error
+	finish      func() error
+}
+
+// newLogExporter prepares an export in the given format; the finetune format
+// defaults the filter to successful requests, and leaves out requests that
+// didn't complete or whose bodies were cut
+func newLogExporter(w io.Writer, format string, filter *LogFilter, dedupe, skipRedacted bool) (*logExporter, error) {
+	e := &logExporter{
+		extension: format,
+		start:     func() error { return nil },
+		finish:    func() error { return nil },
+	}
+
+	switch format {
+	case "jsonl":
+		e.contentType = "application/x-ndjson"
+		enc := json.NewEncoder(w)
+		e.writeEntry = func(entry LogEntry) error {
+			return enc.Encode(entry)
+		}
+
+	case "csv":
+		e.contentType = "text/csv; charset=utf-8"
+		cw := csv.NewWriter(w)
+		e.start = func() error {
+			return cw.Write(csvExportColumns)
+		}
+		e.writeEntry = func(entry LogEntry) error {
+			return cw.Write([]string{
+				strconv.FormatInt(entry.Id, 10),
+				entry.Timestamp,
+				entry.Provider,
+				entry.Method,
+				entry.Model,
+				entry.TargetURL,
+				entry.RequestHeaders,
+				entry.RequestBody,
+				strconv.Itoa(entry.ResponseStatus),
+				entry.ResponseHeaders,
+				entry.ResponseBody,
+				entry.UserAgent,
+				strconv.Itoa(entry.DurationMs),
+				entry.State,
+				entry.Error,
+			})
+		}
+		e.finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	case "har":
+		e.contentType = "application/json"
+		count := 0
+		e.start = func() error {
+			_, err := fmt.Fprintf(w, `{"log":{"version":"1.2","creator":{"name":"llmsee","version":"%s"},"entries":[`, VERSION)
+			return err
+		}
+		e.writeEntry = func(entry LogEntry) error {
+			harEntry, err := json.Marshal(toHAREntry(entry))
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				if _, err := w.Write([]byte(",")); err != nil {
+					return err
+				}
+			}
+			count++
+			_, err = w.Write(harEntry)
+			return err
+		}
+		e.finish = func() error {
+			_, err := fmt.Fprint(w, "]}}\n")
+			return err
+		}
+
+	case "finetune":
+		e.contentType = "application/x-ndjson"
+		e.extension = "jsonl"
+		if filter.Status == 0 {
+			filter.Status = http.StatusOK
+		}
+		seen := make(map[string]bool)
+		enc := json.NewEncoder(w)
+		e.writeEntry = func(entry LogEntry) error {
+			// a partial reply would teach the model to stop mid-sentence
+			if entry.State != logStateCompleted || isCaptureTruncated(entry.RequestBody) || isCaptureTruncated(entry.ResponseBody) {
+				return nil
+			}
+			if skipRedacted && hasRedactionMarker(entry) {
+				return nil
+			}
+			example, ok := toFineTuneExample(entry)
+			if !ok {
+				return nil
+			}
+			if dedupe {
+				key := fineTunePromptKey(example)
+				if seen[key] {
+					return nil
+				}
+				seen[key] = true
+			}
+			return enc.Encode(example)
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected jsonl, csv, har or finetune", format)
+	}
+
+	return e, nil
+}
+
+// write exports every request matching the filter
+func (e *logExporter) write(store Storage, filter LogFilter) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := store.SearchLogs(filter, e.writeEntry); err != nil {
+		return err
+	}
+	return e.finish()
+}
+
+// handleLogExport streams the filtered logs as jsonl, csv, har or finetune
+func (s *ProxyServer) handleLogExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, ok := s.requestLogFilter(w, r)
+	if !ok {
+		return
+	}
+	dedupe, _ := strconv.ParseBool(query.Get("dedupe"))
+	skipRedacted, _ := strconv.ParseBool(query.Get("skip_redacted"))
+
+	exporter, err := newLogExporter(w, defaultString(query.Get("format"), "jsonl"), &filter, dedupe, skipRedacted)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid format, expected jsonl, csv, har or finetune"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", exporter.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="llmsee-%s.%s"`, time.Now().UTC().Format("20060102-150405"), exporter.extension))
+
+	if err := exporter.write(s.store, filter); err != nil {
+		log.Printf("failed to write export: %v", err)
+	}
+}
+
+// toHAREntry maps a log entry onto a HAR entry
+func toHAREntry(entry LogEntry) HAREntry {
+	reqHeaders := harHeaders(entry.RequestHeaders)
+	respHeaders := harHeaders(entry.ResponseHeaders)
+
+	var queryString []HARNameValue
+	if u, err := url.Parse(entry.TargetURL); err == nil {
+		queryString = harValues(u.Query())
+	}
+
+	var postData *HARPostData
+	if entry.RequestBody != "" {
+		postData = &HARPostData{
+			MimeType: headerValue(reqHeaders, "Content-Type", "application/json"),
+			Text:     entry.RequestBody,
+		}
+	}
+
+	duration := max(entry.DurationMs, 0)
+
+	return HAREntry{
+		StartedDateTime: entry.Timestamp,
+		Time:            duration,
+		Request: HARRequest{
+			Method:      entry.Method,
+			URL:         entry.TargetURL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     reqHeaders,
+			QueryString: queryString,
+			PostData:    postData,
+			HeadersSize: -1,
+			BodySize:    entry.RequestBodySize,
+		},
+		Response: HARResponse{
+			Status:      entry.ResponseStatus,
+			StatusText:  http.StatusText(entry.ResponseStatus),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     respHeaders,
+			Content: HARContent{
+				Size:     entry.ResponseBodySize,
+				MimeType: headerValue(respHeaders, "Content-Type", "application/json"),
+				Text:     entry.ResponseBody,
+			},
+			HeadersSize: -1,
+			BodySize:    entry.ResponseBodySize,
+		},
+		Timings: HARTimings{
+			Send:    0,
+			Wait:    duration,
+			Receive: 0,
+		},
+		Comment: fmt.Sprintf("llmsee id=%d provider=%s model=%s", entry.Id, entry.Provider, entry.Model),
+	}
+}
+
+// harHeaders converts stored JSON headers into HAR name/value pairs
+func harHeaders(headersJSON string) []HARNameValue {
+	var headers map[string][]string
+	if headersJSON != "" {
+		json.Unmarshal([]byte(headersJSON), &headers)
+	}
+	return harValues(headers)
+}
+
+// harValues flattens a multi-valued map into sorted HAR name/value pairs
+func harValues(values map[string][]string) []HARNameValue {
+	pairs := []HARNameValue{}
+	for name, vals := range values {
+		for _, v := range vals {
+			pairs = append(pairs, HARNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// headerValue returns the first matching header value or the default
+func headerValue(headers []HARNameValue, name, defaultValue string) string {
+	canonical := http.CanonicalHeaderKey(name)
+	for _, h := range headers {
+		if http.CanonicalHeaderKey(h.Name) == canonical {
+			return h.Value
+		}
+	}
+	return defaultValue
+}
+
+// toFineTuneExample turns a chat completion into a training example, with the reply appended
+func toFineTuneExample(entry LogEntry) (example FineTuneExample, ok bool) {
+	request, ok := parseChatRequest(entry.RequestBody)
+	if !ok {
+		return example, false
+	}
+
+	response, ok := parseChatResponse(entry.ResponseBody)
+	if !ok || (len(response.Message.Content) == 0 && len(response.Message.ToolCalls) == 0) {
+		return example, false
+	}
+
+	example.Messages = append(request.Messages, response.Message)
+	example.Tools = request.Tools
+	return example, true
+}
+
+// fineTunePromptKey identifies an example by everything except the assistant reply
+func fineTunePromptKey(example FineTuneExample) string {
+	prompt := example
+	prompt.Messages = example.Messages[:len(example.Messages)-1]
+	data, _ := json.Marshal(prompt)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// hasRedactionMarker reports whether the request or response contains a redaction marker
+func hasRedactionMarker(entry LogEntry) bool {
+	request := strings.ToLower(entry.RequestBody)
+	response := strings.ToLower(entry.ResponseBody)
+	for _, marker := range redactionMarkers {
+		if strings.Contains(request, marker) || strings.Contains(response, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+type HARFile struct {
+	Log struct {
+		Entries []HARImportEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// HARImportEntry is the subset of a HAR entry read on import
+type HARImportEntry struct {
+	StartedDateTime string  `json:"startedDateTime"`
+	Time            float64 `json:"time"`
+	Comment         string  `json:"comment"`
+	Request         struct {
+		Method   string         `json:"method"`
+		URL      string         `json:"url"`
+		Headers  []HARNameValue `json:"headers"`
+		PostData *HARPostData   `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status  int            `json:"status"`
+		Headers []HARNameValue `json:"headers"`
+		Content struct {
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+// handleLogImport ingests a JSONL or HAR upload into the database
+func (s *ProxyServer) handleLogImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	defer r.Body.Close()
+
+	// a HAR file is read into memory whole
+	result, err := s.importLogs(http.MaxBytesReader(w, r.Body, httpMaxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf(`{"error":"Import too large","message":"the limit is %d bytes"}`, tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"Import failed","message":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// importLogs reads a JSONL or HAR stream, detected from its first JSON object
+func (s *ProxyServer) importLogs(r io.Reader) (result ImportResult, err error) {
+	// the imported rows are in the database by the time the result is out
+	defer s.writer.Flush()
+
+	// rows imported from this stream may still be queued, so aren't in
+	// log_hashes yet
+	seen := make(map[string]bool)
+
+	dec := json.NewDecoder(r)
+
+	var first json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		if err == io.EOF {
+			return result, nil
+		}
+		return result, fmt.Errorf("reading first record: %w", err)
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(first, &probe); err != nil {
+		return result, fmt.Errorf("first record is not an object: %w", err)
+	}
+
+	// HAR is a single document with a top-level "log" object
+	if _, isHAR := probe["log"]; isHAR {
+		var har HARFile
+		if err := json.Unmarshal(first, &har); err != nil {
+			return result, fmt.Errorf("parsing HAR: %w", err)
+		}
+		for _, harEntry := range har.Log.Entries {
+			if err := s.importLogEntry(fromHAREntry(harEntry), seen, &result); err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
+	// otherwise it's one LogEntry per line
+	raw := first
+	for {
+		var entry LogEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return result, fmt.Errorf("parsing record %d: %w", result.Imported+result.Skipped+1, err)
+		}
+		if err := s.importLogEntry(entry, seen, &result); err != nil {
+			return result, err
+		}
+
+		raw = nil
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return result, fmt.Errorf("reading record %d: %w", result.Imported+result.Skipped+1, err)
+		}
+	}
+}
+
+// importLogEntry inserts the entry unless a row with the same content already exists
+func (s *ProxyServer) importLogEntry(entry LogEntry, seen map[string]bool, result *ImportResult) error {
+	hash := logEntryHash(entry)
+	if seen[hash] {
+		result.Skipped++
+		return nil
+	}
+	seen[hash] = true
+
+	exists, err := s.store.HasLogHash(hash)
+	if err != nil {
+		return fmt.Errorf("checking for duplicate: %w", err)
+	}
+	if exists {
+		result.Skipped++
+		return nil
+	}
+
+	// exports of truncated bodies carry their full size
+	entry.RequestBodySize = max(entry.RequestBodySize, len(entry.RequestBody))
+	entry.ResponseBodySize = max(entry.ResponseBodySize, len(entry.ResponseBody))
+	switch {
+	case entry.State == "" && entry.ResponseStatus >= 0:
+		entry.State = logStateCompleted
+	case entry.State == "" || entry.State == logStateInFlight:
+		entry.State = logStateInterrupted
+	}
+	if err := s.queueLogInsert(&entry, hash); err != nil {
+		return fmt.Errorf("inserting log: %w", err)
+	}
+
+	result.Imported++
+	return nil
+}
+
+func (st *sqlStorage) HasLogHash(hash string) (bool, error) {
+	var exists int
+	err := st.db.QueryRow("SELECT COUNT(*) FROM log_hashes WHERE hash = ?", hash).Scan(&exists)
+	return exists > 0, err
+}
+
+// migrateLogHashes hashes the requests finished before rows were hashed as
+// they finished
+func migrateLogHashes(tx *Tx) error {
+	_, err := hashLogs(tx, "logs.state != ?", logStateInFlight)
+	return err
+}
+
+// hashLogs records the content hash of the rows matching the condition that
+// don't have one yet, a batch at a time, so imports can skip them
+func hashLogs(tx *Tx, where string, args ...any) (int, error) {
+	var last int64
+	hashed := 0
+	for {
+		rows, err := tx.Query(`
+			SELECT
+				logs.id,
+				logs.timestamp,
+				logs.provider,
+				logs.method,
+				logs.target_url,
+				logs.response_status,
+				`+payloadColumn("request_body")+`,
+				`+payloadColumn("response_body")+`
+			FROM logs
+			WHERE logs.id > ? AND `+where+`
+				AND NOT EXISTS (SELECT 1 FROM log_hashes h WHERE h.log_id = logs.id)
+			ORDER BY logs.id
+			LIMIT ?`, append(append([]any{last}, args...), payloadMigrateBatch)...)
+		if err != nil {
+			return hashed, err
+		}
+		var batch []LogEntry
+		for rows.Next() {
+			var entry LogEntry
+			payloads, decodePayloads := payloadScan(&entry.RequestBody, &entry.ResponseBody)
+			err := rows.Scan(append([]any{
+				&entry.Id,
+				&entry.Timestamp,
+				&entry.Provider,
+				&entry.Method,
+				&entry.TargetURL,
+				&entry.ResponseStatus,
+			}, payloads...)...)
+			if err == nil {
+				err = decodePayloads()
+			}
+			if err != nil {
+				rows.Close()
+				return hashed, err
+			}
+			batch = append(batch, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return hashed, err
+		}
+		if len(batch) == 0 {
+			return hashed, nil
+		}
+
+		for _, entry := range batch {
+			if err := storeLogHash(tx, logEntryHash(entry), entry.Id); err != nil {
+				return hashed, err
+			}
+		}
+		hashed += len(batch)
+		last = batch[len(batch)-1].Id
+	}
+}
+
+// storeLogHash records the content hash of a row, unless another row has it
+func storeLogHash(db sqlExecer, hash string, id int64) error {
+	_, err := db.Exec("INSERT INTO log_hashes (hash, log_id) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING", hash, id)
+	return err
+}
+
+// logEntryHash identifies a log entry by its content, ignoring the local id
+func logEntryHash(entry LogEntry) string {
+	h := sha256.New()
+	for _, field := range []string{
+		entry.Timestamp,
+		entry.Provider,
+		entry.Method,
+		entry.TargetURL,
+		entry.RequestBody,
+		fmt.Sprint(entry.ResponseStatus),
+		entry.ResponseBody,
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fromHAREntry maps a HAR entry onto a log entry
+func fromHAREntry(harEntry HARImportEntry) LogEntry {
+	timestamp := harEntry.StartedDateTime
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		timestamp = t.UTC().Format(time.RFC3339)
+	}
+
+	var requestBody string
+	if harEntry.Request.PostData != nil {
+		requestBody = harEntry.Request.PostData.Text
+	}
+
+	responseBody := harEntry.Response.Content.Text
+	if harEntry.Response.Content.Encoding == "base64" {
+		if decoded, err := base64.StdEncoding.DecodeString(responseBody); err == nil {
+			responseBody = string(decoded)
+		}
+	}
+
+	reqHeaders := fromHARHeaders(harEntry.Request.Headers)
+
+	entry := LogEntry{
+		Timestamp:       timestamp,
+		Method:          harEntry.Request.Method,
+		TargetURL:       harEntry.Request.URL,
+		RequestHeaders:  reqHeaders,
+		RequestBody:     requestBody,
+		ResponseStatus:  harEntry.Response.Status,
+		ResponseHeaders: fromHARHeaders(harEntry.Response.Headers),
+		ResponseBody:    responseBody,
+		UserAgent:       headerValue(harEntry.Request.Headers, "User-Agent", ""),
+		DurationMs:      int(harEntry.Time),
+	}
+
+	// HAR files exported by llmsee carry the provider and model in the comment
+	for _, field := range strings.Fields(harEntry.Comment) {
+		if value, ok := strings.CutPrefix(field, "provider="); ok {
+			entry.Provider = value
+		}
+		if value, ok := strings.CutPrefix(field, "model="); ok {
+			entry.Model = value
+		}
+	}
+
+	if entry.Provider == "" {
+		if u, err := url.Parse(entry.TargetURL); err == nil {
+			entry.Provider = u.Hostname()
+		}
+	}
+
+	if entry.Model == "" && requestBody != "" {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.Unmarshal([]byte(requestBody), &body); err == nil {
+			entry.Model = body.Model
+		}
+	}
+
+	return entry
+}
+
+// fromHARHeaders converts HAR name/value pairs into the stored JSON header format
+func fromHARHeaders(pairs []HARNameValue) string {
+	headers := make(http.Header)
+	for _, pair := range pairs {
+		// skip HTTP/2 pseudo headers
+		if strings.HasPrefix(pair.Name, ":") {
+			continue
+		}
+		headers.Add(pair.Name, pair.Value)
+	}
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		log.Printf("failed to encode imported headers: %v", err)
+		return ""
+	}
+	return string(headersJSON)
+}
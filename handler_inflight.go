@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// inflightRequest tracks a proxied request until it reaches a terminal state
+type inflightRequest struct {
+	entry    LogEntry
+	started  time.Time
+	status   atomic.Int64
+	received atomic.Int64
+
+	// cancel aborts the upstream call, cancelled tells it apart from other failures
+	cancel    context.CancelFunc
+	cancelled atomic.Bool
+}
+
+// Write counts response bytes received from upstream
+func (i *inflightRequest) Write(p []byte) (int, error) {
+	i.received.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// InflightRequest is a request that hasn't finished, as served by /log/inflight
+type InflightRequest struct {
+	Id             int64  `json:"id"`
+	Timestamp      string `json:"timestamp"`
+	Provider       string `json:"provider"`
+	Model          string `json:"model"`
+	Method         string `json:"method"`
+	TargetURL      string `json:"target_url"`
+	UserAgent      string `json:"useragent"`
+	ResponseStatus int    `json:"response_status"`
+	ReceivedBytes  int64  `json:"received_bytes"`
+	ElapsedMs      int64  `json:"elapsed_ms"`
+}
+
+// trackInflight registers a request that is being proxied, along with the
+// function that cancels its upstream call
+func (s *ProxyServer) trackInflight(entry LogEntry, started time.Time, cancel context.CancelFunc) *inflightRequest {
+	entry.RequestHeaders = ""
+	entry.RequestBody = ""
+	inflight := &inflightRequest{entry: entry, started: started, cancel: cancel}
+	inflight.status.Store(-1)
+
+	s.inflightMu.Lock()
+	s.inflight[entry.Id] = inflight
+	s.inflightMu.Unlock()
+
+	return inflight
+}
+
+// untrackInflight removes a finished request
+func (s *ProxyServer) untrackInflight(inflight *inflightRequest) {
+	s.inflightMu.Lock()
+	if s.inflight[inflight.entry.Id] == inflight {
+		delete(s.inflight, inflight.entry.Id)
+	}
+	s.inflightMu.Unlock()
+}
+
+// handleLogInflight lists the requests currently being proxied, oldest first
+func (s *ProxyServer) handleLogInflight(w http.ResponseWriter, r *http.Request) {
+	requests := []InflightRequest{}
+
+	s.inflightMu.Lock()
+	for _, inflight := range s.inflight {
+		entry := inflight.entry
+		requests = append(requests, InflightRequest{
+			Id:             entry.Id,
+			Timestamp:      entry.Timestamp,
+			Provider:       entry.Provider,
+			Model:          entry.Model,
+			Method:         entry.Method,
+			TargetURL:      entry.TargetURL,
+			UserAgent:      entry.UserAgent,
+			ResponseStatus: int(inflight.status.Load()),
+			ReceivedBytes:  inflight.received.Load(),
+			ElapsedMs:      time.Since(inflight.started).Milliseconds(),
+		})
+	}
+	s.inflightMu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Id < requests[j].Id
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// handleLogCancel aborts the upstream call of an in-flight request; the client
+// gets a clean end of response and the row is marked cancelled
+func (s *ProxyServer) handleLogCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.inflightMu.Lock()
+	inflight := s.inflight[id]
+	s.inflightMu.Unlock()
+
+	if inflight == nil {
+		http.Error(w, `{"error":"Request is not in flight"}`, http.StatusNotFound)
+		return
+	}
+
+	inflight.cancelled.Store(true)
+	inflight.cancel()
+	log.Printf("Cancelled request %d", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"cancelled"}`))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"math"
 	"net/http"
 	"strconv"
@@ -9,15 +11,18 @@ import (
 
 // handleLogList serves the UI data based on the page query
 func (s *ProxyServer) handleLogList(w http.ResponseWriter, r *http.Request) {
-	var totalLogs int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM logs").Scan(&totalLogs)
+	filter, ok := s.requestLogFilter(w, r)
+	if !ok {
+		return
+	}
+	totalLogs, err := s.store.CountLogs(filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	totalPages := totalLogs / s.config.PageSize
-	perPage := s.config.PageSize
+	perPage := s.currentConfig().PageSize
+	totalPages := totalLogs / perPage
 
 	page, err := strconv.Atoi(r.URL.Query().Get("page"))
 	if err != nil {
@@ -36,52 +41,28 @@ func (s *ProxyServer) handleLogList(w http.ResponseWriter, r *http.Request) {
 		offset = (page - 1) * perPage
 	}
 
-	rows, err := s.db.Query(`
-		SELECT
-			id,
-			timestamp,
-			provider,
-			method,
-			model,
-			length(request_body) AS request_body_size,
-			length(response_body) AS response_body_size,
-			response_status,
-			useragent,
-			duration_ms
-		FROM logs
-		ORDER BY timestamp DESC
-		LIMIT ? OFFSET ?
-	`, perPage, offset)
+	logs, err := s.store.ListLogs(filter, perPage, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var logs []LogEntry
-	for rows.Next() {
-		var entry LogEntry
-		err := rows.Scan(
-			&entry.Id,
-			&entry.Timestamp,
-			&entry.Provider,
-			&entry.Method,
-			&entry.Model,
-			&entry.RequestBodySize,
-			&entry.ResponseBodySize,
-			&entry.ResponseStatus,
-			&entry.UserAgent,
-			&entry.DurationMs,
-		)
-		if err != nil {
+	// markers placed among the rows of this page, or after them on the first page
+	markers := []Marker{}
+	if len(logs) > 0 {
+		toLogId := logs[0].Id
+		if page == 1 {
+			toLogId = -1
+		}
+		if markers, err = s.store.ListMarkers(logs[len(logs)-1].Id, toLogId); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		logs = append(logs, entry)
 	}
 
 	response := LogResponse{
 		Logs:        logs,
+		Markers:     markers,
 		TotalPages:  int(math.Ceil(float64(totalLogs) / float64(perPage))),
 		CurrentPage: page,
 		TotalLogs:   totalLogs,
@@ -99,27 +80,16 @@ func (s *ProxyServer) handleLogDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var entry LogEntry
-	err = s.db.QueryRow(`
-		SELECT
-			target_url,
-			model,
-			request_headers,
-			request_body,
-			response_status,
-			response_headers,
-			response_body
-		FROM logs
-		WHERE id = ?
-		`, id).Scan(
-		&entry.TargetURL,
-		&entry.Model,
-		&entry.RequestHeaders,
-		&entry.RequestBody,
-		&entry.ResponseStatus,
-		&entry.ResponseHeaders,
-		&entry.ResponseBody,
-	)
+	entry, err := s.store.GetLog(int64(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		// a request just logged may still be queued
+		s.writer.Flush()
+		entry, err = s.store.GetLog(int64(id))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, `{"error":"Log not found"}`, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
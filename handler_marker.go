@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marker is a named point in the log, placed after the last request logged
+// when it was created. Markers follow the order rows were written in, the
+// seq column of logs, as ids are reserved in blocks by each process and
+// don't follow time across processes.
+type Marker struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	Timestamp string `json:"timestamp"`
+	LogId     int64  `json:"log_id"`
+	LogSeq    int64  `json:"-"`
+}
+
+// migrateLogSeq numbers the rows in write order, starting with the order of
+// their ids
+func migrateLogSeq(tx *Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE logs ADD COLUMN seq INTEGER;
+		UPDATE logs SET seq = id;
+		CREATE INDEX idx_seq ON logs(seq);
+		ALTER TABLE markers ADD COLUMN log_seq INTEGER NOT NULL DEFAULT 0;
+		UPDATE markers SET log_seq = log_id;
+	`)
+	if err != nil || !tx.db.postgres {
+		return err
+	}
+	_, err = tx.Exec(`
+		CREATE SEQUENCE logs_seq;
+		SELECT setval('logs_seq', COALESCE((SELECT MAX(seq) FROM logs), 0) + 1, false);
+	`)
+	return err
+}
+
+// errMarkerNotFound is returned for a filter on a marker that doesn't exist
+var errMarkerNotFound = errors.New("marker not found")
+
+// resolveLogFilter looks up where the markers of a filter are in write order
+func (s *ProxyServer) resolveLogFilter(filter *LogFilter) error {
+	var err error
+	if filter.FromMarker != "" {
+		if filter.fromLogSeq, err = s.store.MarkerLogSeq(filter.FromMarker); err != nil {
+			return err
+		}
+	}
+	if filter.ToMarker != "" {
+		if filter.toLogSeq, err = s.store.MarkerLogSeq(filter.ToMarker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestLogFilter reads the filter of a request. It writes the error
+// response and returns false when a marker of the filter doesn't exist.
+func (s *ProxyServer) requestLogFilter(w http.ResponseWriter, r *http.Request) (LogFilter, bool) {
+	filter := parseLogFilter(r.URL.Query())
+	if err := s.resolveLogFilter(&filter); err != nil {
+		if errors.Is(err, errMarkerNotFound) {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return filter, false
+	}
+	return filter, true
+}
+
+// createMarker records a marker after the latest request
+func (s *ProxyServer) createMarker(name string) (Marker, error) {
+	s.writer.Flush()
+	marker, err := s.store.CreateMarker(strings.TrimSpace(name), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return marker, err
+	}
+
+	log.Printf("Marker %q after request %d", marker.Name, marker.LogId)
+	s.sendSSEUpdate(ServerUpdate{EventType: "marker", Marker: &marker})
+	return marker, nil
+}
+
+func (st *sqlStorage) CreateMarker(name, timestamp string) (Marker, error) {
+	marker := Marker{Name: name, Timestamp: timestamp}
+	err := st.db.QueryRow(`SELECT id, seq FROM logs WHERE seq = (SELECT MAX(seq) FROM logs)`).Scan(&marker.LogId, &marker.LogSeq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return marker, err
+	}
+
+	err = st.db.QueryRow(`INSERT INTO markers (name, timestamp, log_id, log_seq) VALUES (?, ?, ?, ?) RETURNING id`,
+		marker.Name, marker.Timestamp, marker.LogId, marker.LogSeq).Scan(&marker.Id)
+	if err != nil {
+		return marker, err
+	}
+
+	// unnamed markers are named after their id
+	if marker.Name == "" {
+		marker.Name = fmt.Sprintf("marker-%d", marker.Id)
+		if _, err := st.db.Exec(`UPDATE markers SET name = ? WHERE id = ?`, marker.Name, marker.Id); err != nil {
+			return marker, err
+		}
+	}
+	return marker, nil
+}
+
+func (st *sqlStorage) MarkerLogSeq(marker string) (int64, error) {
+	var logSeq int64
+	err := st.db.QueryRow(`
+		SELECT log_seq FROM markers
+		WHERE name = ? OR CAST(id AS TEXT) = ?
+		ORDER BY name = ? DESC, id DESC
+		LIMIT 1`, marker, marker, marker).Scan(&logSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: %s", errMarkerNotFound, marker)
+	}
+	return logSeq, err
+}
+
+func (st *sqlStorage) ListMarkers(fromLogId, toLogId int64) ([]Marker, error) {
+	query := `SELECT id, name, timestamp, log_id FROM markers WHERE log_id >= ?`
+	args := []interface{}{fromLogId}
+	if toLogId >= 0 {
+		query += ` AND log_id <= ?`
+		args = append(args, toLogId)
+	}
+	rows, err := st.db.Query(query+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	markers := []Marker{}
+	for rows.Next() {
+		var marker Marker
+		if err := rows.Scan(&marker.Id, &marker.Name, &marker.Timestamp, &marker.LogId); err != nil {
+			return nil, err
+		}
+		markers = append(markers, marker)
+	}
+	return markers, rows.Err()
+}
+
+func (st *sqlStorage) DeleteMarker(id int64) (bool, error) {
+	result, err := st.db.Exec(`DELETE FROM markers WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// handleMarker lists markers (GET), creates one (POST, with a name from the
+// query or a JSON body) or deletes one (DELETE ?id=)
+func (s *ProxyServer) handleMarker(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		markers, err := s.store.ListMarkers(0, -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(markers)
+
+	case "POST":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" && r.ContentLength != 0 {
+			var body struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxRequestBodySize)).Decode(&body); err != nil {
+				http.Error(w, `{"error":"Invalid marker"}`, http.StatusBadRequest)
+				return
+			}
+			name = body.Name
+		}
+
+		marker, err := s.createMarker(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(marker)
+
+	case "DELETE":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid marker ID"}`, http.StatusBadRequest)
+			return
+		}
+		deleted, err := s.store.DeleteMarker(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, `{"error":"Marker not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"deleted"}`))
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"compress/zlib"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"sort"
 	"strings"
@@ -39,14 +42,20 @@ func parseProvider(r *http.Request) (provider, remainingPath string) {
 }
 
 // proxyHeaders modifies headers for the request based on provider settings
-func proxyHeaders(original http.Header, provider ProviderConfig) http.Header {
+func proxyHeaders(original http.Header, provider ProviderConfig, metadataHeaders []string) http.Header {
 	headers := make(http.Header)
 	for k, v := range original {
-		if k != "Host" && k != "Cookie" && k != "Origin" {
+		// X-Llmsee-* headers are meant for llmsee, not the provider
+		if k != "Host" && k != "Cookie" && k != "Origin" && !strings.HasPrefix(k, "X-Llmsee-") {
 			headers[k] = v
 		}
 	}
 
+	// metadata headers are captured in the log, not forwarded
+	for _, name := range metadataHeaders {
+		headers.Del(name)
+	}
+
 	if provider.ApiKey != "" {
 		headers.Del("Authorization")
 		headers.Set("Authorization", "Bearer "+provider.ApiKey)
@@ -148,7 +157,7 @@ func (s *ProxyServer) fetchJSON(ctx context.Context, headers http.Header, method
 
 func (s *ProxyServer) getGeminiModels(ctx context.Context, providerConfig ProviderConfig) (models []map[string]interface{}, err error) {
 	url := geminiBaseURL + "/models?key=" + providerConfig.ApiKey
-	headers := proxyHeaders(http.Header{}, providerConfig)
+	headers := proxyHeaders(http.Header{}, providerConfig, nil)
 	headers.Del("Authorization")
 	jsonResp, err := s.fetchJSON(ctx, headers, "GET", url)
 	if err != nil {
@@ -191,7 +200,7 @@ func (s *ProxyServer) getModels(ctx context.Context, providerConfig ProviderConf
 	}
 
 	url := providerConfig.BaseURL + "/models"
-	headers := proxyHeaders(http.Header{}, providerConfig)
+	headers := proxyHeaders(http.Header{}, providerConfig, nil)
 	parsed, err := s.fetchJSON(ctx, headers, "GET", url)
 
 	if err != nil {
@@ -229,7 +238,7 @@ func (s *ProxyServer) getAllModels(w http.ResponseWriter, r *http.Request) {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
-	for provider, providerConfig := range s.config.Providers {
+	for provider, providerConfig := range s.currentConfig().Providers {
 		wg.Add(1)
 		go func(provider string, providerConfig ProviderConfig) {
 			defer wg.Done()
@@ -338,7 +347,7 @@ func (s *ProxyServer) handleIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "<tr valign=\"top\">")
 	fmt.Fprint(w, "<td>Provider URLs:</td>")
 	fmt.Fprint(w, "<td>")
-	for provider := range s.config.Providers {
+	for provider := range s.currentConfig().Providers {
 		fmt.Fprintf(w, "<div style=\"margin-bottom:5px\"><a href=\"http://%s/%s\">http://%s/%s</a></div>", r.Host, provider, r.Host, provider)
 	}
 	fmt.Fprint(w, "</td>")
@@ -406,7 +415,8 @@ func (s *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// verify the provider
-	providerConfig, ok := s.config.Providers[provider]
+	config := s.currentConfig()
+	providerConfig, ok := config.Providers[provider]
 	if !ok {
 		http.Error(w, `{"error":"Invalid provider"}`, http.StatusBadRequest)
 		return
@@ -439,38 +449,63 @@ func (s *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		Method:          r.Method,
 		TargetURL:       targetURL,
 		RequestHeaders:  string(reqHeadersJSON),
-		RequestBody:     string(bodyBytes),
+		RequestBody:     captureBody(bodyBytes, len(bodyBytes), config.MaxRequestCapture, ""),
 		RequestBodySize: len(bodyBytes),
+		ResponseStatus:  -1,
 		UserAgent:       r.UserAgent(),
+		DurationMs:      -1,
+		State:           logStateInFlight,
+		Tags:            parseTags(r.Header.Get(tagsHeader)),
+		Metadata:        extractMetadata(r.Header, config.MetadataHeaders),
 	}
 
-	id, err := s.insertLogRequest(entry)
-	if err != nil {
+	if err := s.insertLogRequest(&entry); err != nil {
 		log.Printf("failed to log initial request: %v", err)
 	}
 
-	entry.Id = id
+	// trace the upstream call
+	span := s.startProxySpan(r, provider, model, remainingPath, targetURL, bodyJSON)
+	defer func() { endProxySpan(span, entry) }()
 
 	// send request to target
 	ctx, cancel := context.WithTimeout(r.Context(), httpRequestTimeout)
 	defer cancel()
 
+	inflight := s.trackInflight(entry, startTime, cancel)
+	defer s.untrackInflight(inflight)
+
+	// every row ends in a terminal state, keeping whatever was received before a failure
+	var resp *http.Response
+	received := captureBuffer{limit: config.MaxResponseCapture}
+	state, stateErr := logStateCompleted, error(nil)
+	defer func() {
+		s.finishLogRequest(&entry, resp, &received, state, stateErr, startTime)
+	}()
+
 	if bodyJSON != nil {
 		bodyBytes, _ = json.Marshal(bodyJSON)
 	}
 	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewReader(bodyBytes))
 	if err != nil {
+		state, stateErr = logStateUpstreamError, err
 		http.Error(w, `{"error":"Failed to create proxy request"}`, http.StatusInternalServerError)
 		return
 	}
 
-	proxyReq.Header = proxyHeaders(r.Header, providerConfig)
+	proxyReq.Header = proxyHeaders(r.Header, providerConfig, config.MetadataHeaders)
+	span.Inject(proxyReq.Header)
 
-	resp, err := s.client.Do(proxyReq)
+	resp, err = s.client.Do(proxyReq)
 	if err != nil {
+		state, stateErr = proxyErrorState(inflight, r.Context(), err, logStateUpstreamError)
+		if state == logStateCancelled {
+			http.Error(w, `{"error":"Request cancelled"}`, http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, fmt.Sprintf(`{"error":"Proxy Error","message":"%s"}`, err), http.StatusInternalServerError)
 		return
 	}
+	inflight.status.Store(int64(resp.StatusCode))
 
 	defer func() {
 		io.Copy(io.Discard, resp.Body) // Drain the body
@@ -484,100 +519,140 @@ func (s *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var responseBody string
 	encoding := resp.Header.Get("Content-Encoding")
-	isStreaming := resp.Header.Get("Content-Type") == "text/event-stream"
-
-	if isStreaming {
-		var reader io.Reader = resp.Body
-		var combinedData bytes.Buffer
-
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := reader.Read(buf)
-			if n > 0 {
-				// write to client
-				_, err := w.Write(buf[:n])
-				if err != nil {
-					log.Printf("failed to write chunk: %v", err)
-					break
-				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-
-				// accumulate data for logging
-				combinedData.Write(buf[:n])
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	isStreaming := mediaType == "text/event-stream"
+
+	// every response is passed on as it arrives, so NDJSON streams and large
+	// downloads aren't held back; the status is sent with the first bytes, so
+	// a response failing before then can still be answered with an error
+	// live chunk events are skipped for compressed streams
+	var chunks *chunkCoalescer
+	if isStreaming && encoding == "" {
+		chunks = &chunkCoalescer{s: s, entry: entry}
+		defer chunks.stop()
+	}
+	wroteHeader := false
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if !wroteHeader && (n > 0 || err == io.EOF) {
+			w.WriteHeader(resp.StatusCode)
+			wroteHeader = true
+		}
+		if n > 0 {
+			// accumulate data for logging, kept even if the client has gone
+			captured := received.Len()
+			received.Write(buf[:n])
+			inflight.Write(buf[:n])
+			if chunks != nil {
+				chunks.write(received.Bytes()[captured:])
 			}
-			if err == io.EOF {
-				break
+
+			// write to client
+			if _, err := w.Write(buf[:n]); err != nil {
+				state, stateErr = logStateClientCancelled, err
+				return
 			}
-			if err != nil {
-				log.Printf("failed to read chunk: %v", err)
-				break
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
 			}
-		}
 
-		data := combinedData.Bytes()
-		if encoding != "" {
-			reader, err := decompressBody(bytes.NewReader(data), encoding)
-			if err != nil {
-				log.Printf("failed to create decompression reader: %v", err)
-			} else {
-				decompressedData, err := io.ReadAll(reader)
-				if err != nil {
-					log.Printf("failed to decompress data: %v", err)
-				} else {
-					data = decompressedData
-				}
-			}
 		}
-
-		responseBody = string(data)
-
-	} else {
-		// read response
-		respBuffer, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, `{"error":"Failed to read response body"}`, http.StatusInternalServerError)
+		if err == io.EOF {
 			return
 		}
-
-		// write response to caller
-		_, err = w.Write(respBuffer)
 		if err != nil {
-			log.Printf("failed to write response: %v", err)
+			state, stateErr = proxyErrorState(inflight, r.Context(), err, logStateTruncated)
+			switch {
+			case !wroteHeader:
+				w.Header().Del("Content-Encoding")
+				w.Header().Del("Content-Length")
+				if state == logStateCancelled {
+					http.Error(w, `{"error":"Request cancelled"}`, http.StatusServiceUnavailable)
+					return
+				}
+				http.Error(w, `{"error":"Failed to read response body"}`, http.StatusInternalServerError)
+			case isStreaming:
+				if state == logStateCancelled {
+					// end the stream the way providers report errors, so clients stop cleanly
+					io.WriteString(w, "data: {\"error\":{\"message\":\"Request cancelled\",\"type\":\"cancelled\"}}\n\ndata: [DONE]\n\n")
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+				}
+			case state == logStateCancelled:
+				// a request cancelled from llmsee just stops here
+			default:
+				// break the connection, so the client can't take the part it
+				// got for the whole response
+				panic(http.ErrAbortHandler)
+			}
+			return
 		}
+	}
+}
 
-		// prep response body for logging
-		if encoding == "" {
-			responseBody = string(respBuffer)
+// errCancelled is recorded for requests cancelled through /log/cancel
+var errCancelled = errors.New("cancelled from llmsee")
+
+// proxyErrorState picks the terminal state and error for a failed upstream call or read
+func proxyErrorState(inflight *inflightRequest, clientCtx context.Context, err error, fallback string) (string, error) {
+	var netErr net.Error
+	switch {
+	case inflight.cancelled.Load():
+		return logStateCancelled, errCancelled
+	case clientCtx.Err() != nil:
+		return logStateClientCancelled, err
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return logStateTimeout, err
+	default:
+		return fallback, err
+	}
+}
 
-		} else {
-			decompressedReader, err := decompressBody(bytes.NewReader(respBuffer), encoding)
-			if err != nil {
-				log.Printf("failed to decompress response: %v", err)
-				http.Error(w, `{"error":"Failed to decompress response"}`, http.StatusInternalServerError)
-				return
-			}
-			decompressedBody, err := io.ReadAll(decompressedReader)
+// finishLogRequest records the response received so far and the terminal state of the request
+func (s *ProxyServer) finishLogRequest(entry *LogEntry, resp *http.Response, received *captureBuffer, state string, stateErr error, startTime time.Time) {
+	// a compressed body cut at the capture limit keeps the size it had on the
+	// wire, as its decompressed size isn't known
+	data, size, compressed := received.Bytes(), received.total, ""
+	if resp != nil {
+		respHeadersJSON, _ := json.Marshal(resp.Header)
+		entry.ResponseStatus = resp.StatusCode
+		entry.ResponseHeaders = string(respHeadersJSON)
+
+		// prep response body for logging, partial bodies decompress as far as they go
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && len(data) > 0 {
+			reader, err := decompressBody(bytes.NewReader(data), encoding)
 			if err != nil {
-				log.Printf("failed to read decompressed response: %v", err)
-				http.Error(w, `{"error":"Failed to read decompressed response"}`, http.StatusInternalServerError)
-				return
+				log.Printf("failed to create decompression reader: %v", err)
+			} else {
+				// one byte past the limit tells a body that doesn't fit
+				decompressed, err := io.ReadAll(io.LimitReader(reader, int64(received.limit)+1))
+				if err != nil {
+					log.Printf("failed to decompress response: %v", err)
+				}
+				if err == nil || len(decompressed) > 0 {
+					data = decompressed
+					if received.truncated() || len(decompressed) > received.limit {
+						compressed = encoding
+					} else {
+						size = len(decompressed)
+					}
+				}
 			}
-			responseBody = string(decompressedBody)
 		}
 	}
 
-	// update the request
-	respHeadersJSON, _ := json.Marshal(resp.Header)
-	entry.ResponseStatus = resp.StatusCode
-	entry.ResponseHeaders = string(respHeadersJSON)
-	entry.ResponseBody = responseBody
-	entry.ResponseBodySize = len(responseBody)
+	entry.ResponseBody = captureBody(data, size, received.limit, compressed)
+	entry.ResponseBodySize = size
 	entry.DurationMs = int(time.Since(startTime).Milliseconds())
-	if err := s.updateLogRequest(entry); err != nil {
+	entry.State = state
+	if stateErr != nil {
+		entry.Error = stateErr.Error()
+	}
+	if err := s.updateLogRequest(*entry); err != nil {
 		log.Printf("failed to update request log: %v", err)
 	}
 }
@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// chunkEventInterval is the minimum time between chunk events of a streaming response
+const chunkEventInterval = 200 * time.Millisecond
+
 type SSEClient struct {
 	id     string
 	events chan ServerUpdate
@@ -18,6 +23,10 @@ type SSEClient struct {
 type ServerUpdate struct {
 	EventType string   `json:"eventType"`
 	Entry     LogEntry `json:"entry"`
+	Message   string   `json:"message,omitempty"`
+	Chunk     string   `json:"chunk,omitempty"`
+	Seq       int      `json:"seq,omitempty"`
+	Marker    *Marker  `json:"marker,omitempty"`
 }
 
 func generateClientID() string {
@@ -41,6 +50,86 @@ func (s *ProxyServer) sendSSEUpdate(update ServerUpdate) {
 	}
 }
 
+// sendChunkUpdate broadcasts the streamed response data received since the
+// previous chunk event; seq counts the events of a request so clients can
+// tell when one was dropped
+func (s *ProxyServer) sendChunkUpdate(entry LogEntry, chunk []byte, seq int) {
+	s.sendSSEUpdate(ServerUpdate{
+		EventType: "chunk",
+		Entry: LogEntry{
+			Id:             entry.Id,
+			Timestamp:      entry.Timestamp,
+			Provider:       entry.Provider,
+			Model:          entry.Model,
+			ResponseStatus: -1,
+			DurationMs:     -1,
+		},
+		Chunk: string(chunk),
+		Seq:   seq,
+	})
+}
+
+// chunkCoalescer collects the streamed response data of a request into chunk
+// events at most every chunkEventInterval. Data held back is sent when the
+// interval is up, even if the stream stalls meanwhile.
+type chunkCoalescer struct {
+	s     *ProxyServer
+	entry LogEntry
+
+	mu      sync.Mutex
+	pending []byte
+	seq     int
+	last    time.Time
+	timer   *time.Timer
+	stopped bool
+}
+
+// write adds data received from upstream
+func (c *chunkCoalescer) write(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped || len(data) == 0 {
+		return
+	}
+	c.pending = append(c.pending, data...)
+	if wait := chunkEventInterval - time.Since(c.last); wait <= 0 {
+		c.send()
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(wait, c.flush)
+	}
+}
+
+// flush sends the pending data once the interval is up
+func (c *chunkCoalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if !c.stopped {
+		c.send()
+	}
+}
+
+func (c *chunkCoalescer) send() {
+	if len(c.pending) == 0 {
+		return
+	}
+	c.seq++
+	c.s.sendChunkUpdate(c.entry, c.pending, c.seq)
+	c.pending = nil
+	c.last = time.Now()
+}
+
+// stop drops the pending data, as the final update of the request carries
+// the whole response
+func (c *chunkCoalescer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
 // handle SSE
 func (s *ProxyServer) handleSse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
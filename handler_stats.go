@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// groupStats accumulates the stats of one group of requests
+type groupStats struct {
+	Group            string  `json:"group"`
+	Provider         string  `json:"provider,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	Pending          int     `json:"pending"`
+	Timed            int     `json:"-"`
+	TotalMs          int     `json:"-"`
+	AvgMs            int     `json:"avg_ms"`
+	MaxMs            int     `json:"max_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	Priced           bool    `json:"priced"`
+}
+
+// StatsResponse is served by /stats
+type StatsResponse struct {
+	GroupBy string        `json:"group_by"`
+	Groups  []*groupStats `json:"groups"`
+	Total   *groupStats   `json:"total"`
+}
+
+// LogStats are the totals of the requests of one provider, model and
+// metadata value, read without their bodies
+type LogStats struct {
+	Provider         string
+	Model            string
+	Metadata         string
+	Requests         int
+	Errors           int
+	Pending          int
+	Timed            int
+	TotalMs          int
+	MaxMs            int
+	Usages           int // requests with a token usage
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// logUsage is the token usage of a response, stored with the row so stats
+// don't need the bodies; nil when the response has none
+func logUsage(entry LogEntry) (promptTokens, completionTokens any) {
+	response, ok := parseChatResponse(entry.ResponseBody)
+	if !ok || response.Usage == nil {
+		return nil, nil
+	}
+	return response.Usage.PromptTokens, response.Usage.CompletionTokens
+}
+
+// migrateUsage adds the token usage columns, filled in from the responses
+// logged so far
+func migrateUsage(tx *Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE logs ADD COLUMN prompt_tokens INTEGER;
+		ALTER TABLE logs ADD COLUMN completion_tokens INTEGER;
+	`)
+	if err != nil {
+		return err
+	}
+
+	var last int64
+	counted := 0
+	for {
+		rows, err := tx.Query(`
+			SELECT id, `+payloadColumn("response_body")+`
+			FROM logs
+			WHERE id > ? AND response_body_hash IS NOT NULL
+			ORDER BY id
+			LIMIT ?`, last, payloadMigrateBatch)
+		if err != nil {
+			return err
+		}
+		var batch []LogEntry
+		for rows.Next() {
+			var entry LogEntry
+			dest, decode := payloadScan(&entry.ResponseBody)
+			err := rows.Scan(append([]any{&entry.Id}, dest...)...)
+			if err == nil {
+				err = decode()
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, entry := range batch {
+			last = entry.Id
+			promptTokens, completionTokens := logUsage(entry)
+			if promptTokens == nil {
+				continue
+			}
+			_, err := tx.Exec(`UPDATE logs SET prompt_tokens = ?, completion_tokens = ? WHERE id = ?`,
+				promptTokens, completionTokens, entry.Id)
+			if err != nil {
+				return err
+			}
+			counted++
+		}
+	}
+	if counted > 0 {
+		log.Printf("Recorded the token usage of %d request(s)", counted)
+	}
+	return nil
+}
+
+// LogStats sums up the requests matching the filter by provider and model,
+// and by the value of a metadata key when given
+func (st *sqlStorage) LogStats(filter LogFilter, metadataKey string) ([]LogStats, error) {
+	metadata := "''"
+	if metadataKey != "" {
+		metadata = "COALESCE(" + st.db.metadataExpr(metadataKey) + ", '')"
+	}
+	where, args := filter.where(st.db)
+	rows, err := st.db.Query(`
+		SELECT
+			provider,
+			model,
+			`+metadata+`,
+			COUNT(*),
+			SUM(CASE WHEN state = ? THEN 0 WHEN state != ? OR response_status >= 400 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN state = ? THEN 1 ELSE 0 END),
+			SUM(CASE WHEN state != ? AND duration_ms >= 0 THEN 1 ELSE 0 END),
+			COALESCE(SUM(CASE WHEN state != ? AND duration_ms >= 0 THEN duration_ms END), 0),
+			COALESCE(MAX(CASE WHEN state != ? AND duration_ms >= 0 THEN duration_ms END), 0),
+			COUNT(CASE WHEN state != ? THEN prompt_tokens END),
+			COALESCE(SUM(CASE WHEN state != ? THEN prompt_tokens END), 0),
+			COALESCE(SUM(CASE WHEN state != ? THEN completion_tokens END), 0)
+		FROM logs
+		`+where+`
+		GROUP BY 1, 2, 3
+	`, append([]any{
+		logStateInFlight, logStateCompleted, logStateInFlight, logStateInFlight, logStateInFlight,
+		logStateInFlight, logStateInFlight, logStateInFlight, logStateInFlight,
+	}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []LogStats
+	for rows.Next() {
+		var stat LogStats
+		err := rows.Scan(&stat.Provider, &stat.Model, &stat.Metadata, &stat.Requests, &stat.Errors, &stat.Pending,
+			&stat.Timed, &stat.TotalMs, &stat.MaxMs, &stat.Usages, &stat.PromptTokens, &stat.CompletionTokens)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// computeStats summarises the filtered requests by group: model (provider
+// and model), provider, or meta.<key> for a metadata value; groups are
+// sorted by request count
+func (s *ProxyServer) computeStats(filter LogFilter, group string) ([]*groupStats, *groupStats, error) {
+	var metaKey string
+	var groupOf func(LogStats) (key string, stat groupStats)
+	switch {
+	case group == "model":
+		groupOf = func(row LogStats) (string, groupStats) {
+			return row.Provider + "\x00" + row.Model, groupStats{Group: row.Provider + ":" + row.Model, Provider: row.Provider, Model: row.Model}
+		}
+	case group == "provider":
+		groupOf = func(row LogStats) (string, groupStats) {
+			return row.Provider, groupStats{Group: row.Provider, Provider: row.Provider}
+		}
+	case strings.HasPrefix(group, "meta.") && metadataKey(group[5:]) != "":
+		metaKey = metadataKey(group[5:])
+		groupOf = func(row LogStats) (string, groupStats) {
+			return row.Metadata, groupStats{Group: row.Metadata}
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid group %q, expected model, provider or meta.<key>", group)
+	}
+
+	rows, err := s.store.LogStats(filter, metaKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	providers := s.currentConfig().Providers
+	stats := make(map[string]*groupStats)
+	total := &groupStats{Group: "total", Provider: "total"}
+	for _, row := range rows {
+		key, initial := groupOf(row)
+		stat, ok := stats[key]
+		if !ok {
+			stat = &initial
+			stats[key] = stat
+		}
+
+		for _, st := range []*groupStats{stat, total} {
+			st.Requests += row.Requests
+			st.Errors += row.Errors
+			st.Pending += row.Pending
+			st.Timed += row.Timed
+			st.TotalMs += row.TotalMs
+			st.MaxMs = max(st.MaxMs, row.MaxMs)
+
+			if row.Usages > 0 {
+				st.PromptTokens += row.PromptTokens
+				st.CompletionTokens += row.CompletionTokens
+				providerConfig := providers[row.Provider]
+				usage := &ChatUsage{PromptTokens: row.PromptTokens, CompletionTokens: row.CompletionTokens}
+				if cost, ok := providerConfig.Cost(row.Model, usage); ok {
+					st.Cost += cost
+					st.Priced = true
+				}
+			}
+		}
+	}
+
+	list := []*groupStats{}
+	for _, stat := range stats {
+		list = append(list, stat)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Requests != list[j].Requests {
+			return list[i].Requests > list[j].Requests
+		}
+		return list[i].Group < list[j].Group
+	})
+
+	for _, stat := range append(list, total) {
+		stat.AvgMs = -1
+		if stat.Timed > 0 {
+			stat.AvgMs = stat.TotalMs / stat.Timed
+		}
+	}
+	return list, total, nil
+}
+
+// handleStats serves request, latency, token and cost totals grouped by
+// the group query (model, provider or meta.<key>), accepting the /log filters
+func (s *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "model"
+	}
+
+	filter, ok := s.requestLogFilter(w, r)
+	if !ok {
+		return
+	}
+	list, total, err := s.computeStats(filter, group)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatsResponse{GroupBy: group, Groups: list, Total: total})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogWrite is a queued insert or update of a request
+type LogWrite struct {
+	Entry      LogEntry
+	Update     bool
+	ImportHash string // content hash of an imported entry, stored in log_hashes with it
+
+	flushed chan struct{} // set on a flush marker instead of a write
+}
+
+// LogWriterStats is served by /log/writer
+type LogWriterStats struct {
+	Queued   int   `json:"queued"`
+	Capacity int   `json:"capacity"`
+	Written  int64 `json:"written"`
+	Batches  int64 `json:"batches"`
+	Delayed  int64 `json:"delayed"` // waited for room in a full queue
+	Dropped  int64 `json:"dropped"` // new requests still without room after logWriteMaxDelay
+	Failed   int64 `json:"failed"`  // rejected by the database
+}
+
+// logWriter writes requests to the store from a single goroutine, so that
+// proxied requests never wait on the database. New requests are threaded into
+// conversations there too, just before they're written. The writer also reserves the ids of new
+// requests ahead of time, topping them up after each batch so that a request
+// only reserves ids itself when a burst used them all up. Writes queued meanwhile are
+// batched into one transaction. When the queue is full a new request waits
+// up to logWriteMaxDelay for room and is then dropped, rather than holding up
+// the request any longer. Responses and imports wait for room however long it
+// takes, as a dropped response would leave its request in flight for good.
+type logWriter struct {
+	store Storage
+	queue chan LogWrite
+	done  chan struct{}
+
+	closeMu sync.RWMutex // held for reading while queueing, so close waits for senders
+	closed  bool
+
+	idMu sync.Mutex
+	ids  []int64 // reserved and not handed out yet, in order
+
+	written, batches, delayed, dropped, failed atomic.Int64
+}
+
+// newLogWriter starts the writer of a store
+func newLogWriter(store Storage) *logWriter {
+	w := &logWriter{
+		store: store,
+		queue: make(chan LogWrite, logWriteQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// nextId hands out an id for a new request from the reserved ones
+func (w *logWriter) nextId() (int64, error) {
+	w.idMu.Lock()
+	defer w.idMu.Unlock()
+	if len(w.ids) == 0 {
+		ids, err := w.store.ReserveLogIds()
+		if err != nil {
+			return 0, err
+		}
+		w.ids = ids
+	}
+	id := w.ids[0]
+	w.ids = w.ids[1:]
+	return id, nil
+}
+
+// prefetchIds reserves the next block of ids once fewer than half a block
+// are left, without holding up nextId meanwhile
+func (w *logWriter) prefetchIds() {
+	w.idMu.Lock()
+	left := len(w.ids)
+	w.idMu.Unlock()
+	if left >= logIdBlock/2 {
+		return
+	}
+
+	ids, err := w.store.ReserveLogIds()
+	if err != nil {
+		log.Printf("failed to reserve log ids: %v", err)
+		return
+	}
+	w.idMu.Lock()
+	w.ids = append(w.ids, ids...)
+	w.idMu.Unlock()
+}
+
+// insert queues a new request, or an imported one given its content hash
+func (w *logWriter) insert(entry LogEntry, importHash string) {
+	w.enqueue(LogWrite{Entry: entry, ImportHash: importHash}, importHash != "")
+}
+
+// update queues the response of a request
+func (w *logWriter) update(entry LogEntry) {
+	w.enqueue(LogWrite{Entry: entry, Update: true}, true)
+}
+
+func (w *logWriter) enqueue(write LogWrite, wait bool) {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		w.drop(write, "the log writer is stopped")
+		return
+	}
+
+	select {
+	case w.queue <- write:
+		return
+	default:
+	}
+
+	w.delayed.Add(1)
+	if wait {
+		w.queue <- write
+		return
+	}
+	timer := time.NewTimer(logWriteMaxDelay)
+	defer timer.Stop()
+	select {
+	case w.queue <- write:
+	case <-timer.C:
+		w.drop(write, "the log queue is full")
+	}
+}
+
+func (w *logWriter) drop(write LogWrite, reason string) {
+	w.dropped.Add(1)
+	if write.Update {
+		log.Printf("[ID:%d] response not logged: %s", write.Entry.Id, reason)
+	} else {
+		log.Printf("[ID:%d] request not logged: %s", write.Entry.Id, reason)
+	}
+}
+
+// Flush waits until everything queued so far is written
+func (w *logWriter) Flush() {
+	flushed := make(chan struct{})
+	w.closeMu.RLock()
+	if w.closed {
+		w.closeMu.RUnlock()
+		return
+	}
+	w.queue <- LogWrite{flushed: flushed}
+	w.closeMu.RUnlock()
+	<-flushed
+}
+
+// Close writes what's left in the queue and stops the writer
+func (w *logWriter) Close() {
+	w.closeMu.Lock()
+	if w.closed {
+		w.closeMu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.closeMu.Unlock()
+	<-w.done
+
+	stats := w.Stats()
+	log.Printf("Log writer stopped: %d write(s) in %d batch(es), %d delayed, %d dropped, %d failed",
+		stats.Written, stats.Batches, stats.Delayed, stats.Dropped, stats.Failed)
+}
+
+// Stats reports the activity of the writer since it started
+func (w *logWriter) Stats() LogWriterStats {
+	return LogWriterStats{
+		Queued:   len(w.queue),
+		Capacity: cap(w.queue),
+		Written:  w.written.Load(),
+		Batches:  w.batches.Load(),
+		Delayed:  w.delayed.Load(),
+		Dropped:  w.dropped.Load(),
+		Failed:   w.failed.Load(),
+	}
+}
+
+// run writes batches until the queue is closed and drained
+func (w *logWriter) run() {
+	defer close(w.done)
+	w.prefetchIds()
+	for write := range w.queue {
+		batch := []LogWrite{write}
+	collect:
+		for len(batch) < logWriteMaxBatch {
+			select {
+			case next, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		w.write(batch)
+		w.prefetchIds()
+	}
+}
+
+// write stores a batch in one transaction, falling back to one write at a
+// time so a bad row doesn't lose the others
+func (w *logWriter) write(batch []LogWrite) {
+	var writes []LogWrite
+	var flushes []chan struct{}
+	for _, write := range batch {
+		if write.flushed != nil {
+			flushes = append(flushes, write.flushed)
+		} else {
+			writes = append(writes, write)
+		}
+	}
+
+	if len(writes) > 0 {
+		w.thread(writes)
+		if err := w.store.WriteLogs(writes); err == nil {
+			w.written.Add(int64(len(writes)))
+			w.batches.Add(1)
+		} else {
+			log.Printf("failed to write %d log(s) at once, retrying one at a time: %v", len(writes), err)
+			for _, write := range writes {
+				if err := w.store.WriteLogs([]LogWrite{write}); err != nil {
+					w.failed.Add(1)
+					log.Printf("[ID:%d] failed to write log: %v", write.Entry.Id, err)
+					continue
+				}
+				w.written.Add(1)
+				w.batches.Add(1)
+			}
+		}
+	}
+
+	for _, flushed := range flushes {
+		close(flushed)
+	}
+}
+
+// thread assigns the new requests of a batch to conversations, in order, so
+// that each can continue the ones before it
+func (w *logWriter) thread(writes []LogWrite) {
+	unwritten := make(map[string]string)
+	for i := range writes {
+		if writes[i].Update {
+			continue
+		}
+		entry := &writes[i].Entry
+		if err := threadConversation(w.store, entry, unwritten); err != nil {
+			log.Printf("[ID:%d] failed to thread conversation: %v", entry.Id, err)
+		}
+		if entry.MessagesHash != "" && entry.ConversationId != "" {
+			unwritten[entry.MessagesHash] = entry.ConversationId
+		}
+	}
+}
+
+// handleLogWriter serves the stats of the log writer
+func (s *ProxyServer) handleLogWriter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.writer.Stats())
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,20 +20,27 @@ const VERSION = "0.9.0"
 type ProxyServer struct {
 	devMode        bool
 	config         Config
-	db             *sql.DB
+	configFile     string
+	configMu       sync.RWMutex
+	store          Storage
+	writer         *logWriter
 	mu             sync.RWMutex
 	client         *http.Client
 	clientChannels map[string]*SSEClient
+	tracer         *Tracer
+	notifier       *Notifier
+	inflight       map[int64]*inflightRequest
+	inflightMu     sync.Mutex
 }
 
 // NewProxyServer initializes the proxy server
-func NewProxyServer() (*ProxyServer, error) {
-	config, err := getConfig()
+func NewProxyServer(configFile string) (*ProxyServer, error) {
+	config, err := getConfig(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := getDb(config.DatabaseFile)
+	db, err := openDatabase(config)
 	if err != nil {
 		return nil, err
 	}
@@ -47,37 +54,87 @@ func NewProxyServer() (*ProxyServer, error) {
 		},
 	}
 
+	store := &sqlStorage{db: db}
 	return &ProxyServer{
 		devMode:        os.Getenv("APP_ENV") == "dev",
 		config:         *config,
-		db:             db,
+		configFile:     configFile,
+		store:          store,
+		writer:         newLogWriter(store),
 		client:         client,
 		clientChannels: make(map[string]*SSEClient),
+		tracer:         NewTracer(config.Tracing),
+		notifier:       NewNotifier(),
+		inflight:       make(map[int64]*inflightRequest),
 	}, nil
 }
 
-// main function starts the server
+// Close writes the queued logs and closes the database
+func (s *ProxyServer) Close() error {
+	s.writer.Close()
+	return s.store.Close()
+}
+
+// main function runs a subcommand, serving by default
 func main() {
+	flag.Usage = printUsage
 	log.Printf("LLMSee %s", VERSION)
-	server, err := NewProxyServer()
+	configFile := findConfigFile()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if err := runCommand(configFile, args); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// runServe starts the proxy and web UI, and blocks until interrupted
+func runServe(configFile string) error {
+	server, err := NewProxyServer(configFile)
 	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+		return fmt.Errorf("failed to initialize server: %w", err)
 	}
-	defer server.db.Close()
+	defer server.Close()
 
 	if server.devMode {
 		log.Print("Developer mode enabled")
 	}
 
+	if err := server.markInterruptedRequests(); err != nil {
+		log.Printf("failed to mark unfinished requests: %v", err)
+	}
+
+	if err := server.backfillConversations(); err != nil {
+		log.Printf("failed to thread earlier requests: %v", err)
+	}
+
+	if err := server.store.IndexMetadata(server.currentConfig().MetadataHeaders); err != nil {
+		log.Printf("failed to index metadata: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ui/sse", server.handleSse)
 	mux.HandleFunc("/ui/", server.handleUI)
 	mux.HandleFunc("/log", server.handleLogList)
 	mux.HandleFunc("/log/detail", server.handleLogDetail)
+	mux.HandleFunc("/log/annotation", server.handleLogAnnotation)
+	mux.HandleFunc("/log/inflight", server.handleLogInflight)
+	mux.HandleFunc("/log/cancel", server.handleLogCancel)
+	mux.HandleFunc("/log/export", server.handleLogExport)
+	mux.HandleFunc("/log/import", server.handleLogImport)
+	mux.HandleFunc("/log/writer", server.handleLogWriter)
+	mux.HandleFunc("/marker", server.handleMarker)
+	mux.HandleFunc("/stats", server.handleStats)
+	mux.HandleFunc("/conversations", server.handleConversationList)
+	mux.HandleFunc("/conversations/detail", server.handleConversationDetail)
+	mux.HandleFunc("/conversations/trace", server.handleConversationTrace)
 	mux.HandleFunc("/favicon.ico", server.handleFavIcon)
 	mux.HandleFunc("/", server.handleProxy)
 
-	addr := fmt.Sprintf("%s:%d", server.config.Host, server.config.Port)
+	config := server.currentConfig()
+	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
 
 	httpServer := &http.Server{
 		Addr:           addr,
@@ -101,6 +158,22 @@ func main() {
 	// Print server information
 	log.Printf("Server Ready: http://%s", addr)
 
+	// Reload the config when the file changes or on SIGHUP
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go server.watchConfig(watchCtx)
+
+	// Close out requests other instances of a shared database left in flight
+	go server.expireInFlightRequests(watchCtx)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			server.reloadConfig("SIGHUP")
+		}
+	}()
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -115,8 +188,14 @@ func main() {
 	server.gracefulShutdownSSE()
 
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Server forced to shutdown: %v", err)
 	} else {
 		log.Println("Server stopped gracefully")
 	}
+
+	// Write the queued logs, then export any remaining spans and notifications
+	server.writer.Close()
+	server.tracer.Shutdown(ctx)
+	server.notifier.Shutdown(ctx)
+	return nil
 }
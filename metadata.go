@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// metadataKey names the metadata captured from a header: lower case without
+// an X- prefix, so X-Test-Name is stored as test-name
+func metadataKey(header string) string {
+	key := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(header)), "x-")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, key)
+}
+
+// extractMetadata reads the configured metadata headers of a request
+func extractMetadata(header http.Header, metadataHeaders []string) map[string]string {
+	var metadata map[string]string
+	for _, name := range metadataHeaders {
+		if value := strings.TrimSpace(header.Get(name)); value != "" {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[metadataKey(name)] = value
+		}
+	}
+	return metadata
+}
+
+// encodeMetadata stores metadata as a JSON object
+func encodeMetadata(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(metadata)
+	return string(data)
+}
+
+// decodeMetadata reads a stored metadata object, nil when empty
+func decodeMetadata(data string) map[string]string {
+	var metadata map[string]string
+	json.Unmarshal([]byte(data), &metadata)
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+func (st *sqlStorage) IndexMetadata(metadataHeaders []string) error {
+	for _, name := range metadataHeaders {
+		key := metadataKey(name)
+		if key == "" {
+			continue
+		}
+		// a-b and a_b share a name once dashes are replaced, so a hash of the
+		// key tells them apart; it goes first so a truncated name keeps it
+		name := strings.ReplaceAll(key, "-", "_")
+		sum := sha256.Sum256([]byte(key))
+		index := fmt.Sprintf("idx_metadata_%x_%s", sum[:4], name)
+
+		// replace the index named without the hash by earlier versions
+		if _, err := st.db.Exec(`DROP INDEX IF EXISTS idx_metadata_` + name); err != nil {
+			return fmt.Errorf("indexing metadata %s: %w", key, err)
+		}
+		_, err := st.db.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON logs(%s)`, index, st.db.metadataExpr(key)))
+		if err != nil {
+			return fmt.Errorf("indexing metadata %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration changes the schema from the previous version to the next; each
+// runs in its own transaction and is recorded in schema_version
+type migration struct {
+	description string
+	apply       func(tx *Tx) error
+}
+
+// sqliteMigrations are applied in order, the schema version being the
+// number applied. Append new ones, never edit or reorder released ones.
+var sqliteMigrations = []migration{
+	{"initial schema", migrateInitialSchema},
+	{"move headers and bodies to compressed payloads", migratePayloads},
+	{"record token usage for stats", migrateUsage},
+	{"place markers in write order", migrateLogSeq},
+	{"hash finished requests for import deduplication", migrateLogHashes},
+}
+
+// migrationLock serializes PostgreSQL migrations between llmsee instances
+// sharing a database
+const migrationLock = 0x6c6c6d736565 // "llmsee"
+
+// migrateDatabase applies the migrations a database hasn't had yet, after
+// backing up a SQLite file
+func migrateDatabase(db *DB, dbPath string) error {
+	migrations := sqliteMigrations
+	if db.postgres {
+		migrations = postgresMigrations
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied TEXT NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this version of llmsee supports (%d)", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	// databases from before schema_version existed start at version 0, but
+	// have data worth keeping
+	if !db.postgres {
+		var tables int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'logs'`).Scan(&tables); err != nil {
+			return err
+		}
+		if tables > 0 {
+			backup := fmt.Sprintf("%s.v%d-%s.bak", dbPath, version, time.Now().Format("20060102-150405"))
+			if _, err := db.Exec(`VACUUM INTO ?`, backup); err != nil {
+				return fmt.Errorf("backing up database: %w", err)
+			}
+			log.Printf("Backed up the database to %s before migrating", backup)
+		}
+	}
+
+	for i := version; i < len(migrations); i++ {
+		applied, err := applyMigration(db, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, migrations[i].description, err)
+		}
+		if applied {
+			log.Printf("Database migrated to version %d: %s", i+1, migrations[i].description)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records it in one transaction, unless
+// another instance applied it first
+func applyMigration(db *DB, version int, m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if db.postgres {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLock); err != nil {
+			return false, err
+		}
+	}
+	var done int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_version WHERE version = ?`, version).Scan(&done); err != nil {
+		return false, err
+	}
+	if done > 0 {
+		return false, nil
+	}
+
+	if err := m.apply(tx); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)`,
+		version, m.description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// migrateInitialSchema creates the schema as it was before migrations were
+// versioned; tables and columns are only added when missing, so databases of
+// any earlier release are brought to the same state
+func migrateInitialSchema(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			method TEXT NOT NULL,
+			model TEXT NOT NULL,
+			target_url TEXT NOT NULL,
+			request_headers TEXT NOT NULL DEFAULT '',
+			request_body TEXT NOT NULL DEFAULT '',
+			response_status INT NOT NULL DEFAULT -1,
+			response_headers TEXT NOT NULL DEFAULT '',
+			response_body TEXT NOT NULL DEFAULT '',
+			useragent TEXT NOT NULL DEFAULT '',
+			duration_ms INTEGER NOT NULL DEFAULT -1
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_timestamp ON logs(timestamp);
+
+		CREATE TABLE IF NOT EXISTS log_hashes (
+			hash TEXT PRIMARY KEY,
+			log_id INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS log_annotations (
+			log_id INTEGER PRIMARY KEY,
+			tags TEXT NOT NULL DEFAULT '[]',
+			note TEXT NOT NULL DEFAULT '',
+			starred INTEGER NOT NULL DEFAULT 0,
+			updated TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_annotations_starred ON log_annotations(starred);
+
+		CREATE TABLE IF NOT EXISTS markers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			timestamp TEXT NOT NULL,
+			log_id INTEGER NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_markers_name ON markers(name);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []struct{ name, definition string }{
+		{"state", "TEXT NOT NULL DEFAULT ''"},
+		{"error", "TEXT NOT NULL DEFAULT ''"},
+		{"conversation_id", "TEXT NOT NULL DEFAULT ''"},
+		{"messages_hash", "TEXT"}, // NULL until threaded by backfillConversations
+		{"metadata", "TEXT NOT NULL DEFAULT '{}'"},
+	} {
+		if err := addColumnIfMissing(tx, "logs", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_conversation_id ON logs(conversation_id);
+		CREATE INDEX IF NOT EXISTS idx_messages_hash ON logs(messages_hash);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// rows from before states were recorded
+	_, err = tx.Exec(`UPDATE logs SET state = ? WHERE state = '' AND response_status >= 0`, logStateCompleted)
+	return err
+}
+
+// addColumnIfMissing adds a column to a table created by an older version
+func addColumnIfMissing(db sqlExecer, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// hasColumn reports whether a table has a column
+func hasColumn(db sqlExecer, table, column string) (bool, error) {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	return exists > 0, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Headers and bodies are stored once per distinct content in the payloads
+// table, zstd compressed and keyed by the SHA-256 of the content. Each logs
+// row refers to its payloads with the <column>_hash columns, where NULL (or
+// an empty hash, in rows of earlier versions) stands for empty content.
+
+const payloadMigrateBatch = 200 // Rows read at a time when moving to the payloads table
+
+// payloadColumns are the logs columns stored as payloads
+var payloadColumns = []string{"request_headers", "request_body", "response_headers", "response_body"}
+
+var (
+	payloadEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	payloadDecoder, _ = zstd.NewReader(nil)
+)
+
+// payloadColumn is the SQL reading the compressed payload of a logs column,
+// decoded with decodePayload
+func payloadColumn(column string) string {
+	return fmt.Sprintf("(SELECT data FROM payloads WHERE hash = logs.%s_hash)", column)
+}
+
+// storePayload saves content unless a payload with the same content exists,
+// and returns its hash, or nil for empty content
+func storePayload(db sqlExecer, content string) (any, error) {
+	if content == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM payloads WHERE hash = ?`, hash).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		return hash, nil
+	}
+
+	data := payloadEncoder.EncodeAll([]byte(content), nil)
+	_, err := db.Exec(`INSERT INTO payloads (hash, data, size) VALUES (?, ?, ?) ON CONFLICT (hash) DO NOTHING`, hash, data, len(content))
+	return hash, err
+}
+
+// decodePayload decompresses a payload read with payloadColumn
+func decodePayload(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	content, err := payloadDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return "", fmt.Errorf("decompressing payload: %w", err)
+	}
+	return string(content), nil
+}
+
+// payloadScan returns scan destinations for payloadColumn values, and a
+// function that decodes them into the given strings once scanned
+func payloadScan(targets ...*string) (dest []any, decode func() error) {
+	data := make([][]byte, len(targets))
+	for i := range data {
+		dest = append(dest, &data[i])
+	}
+	return dest, func() error {
+		for i, target := range targets {
+			content, err := decodePayload(data[i])
+			if err != nil {
+				return err
+			}
+			*target = content
+		}
+		return nil
+	}
+}
+
+// deleteUnusedPayloads removes payloads no longer referred to by any log. On
+// PostgreSQL, a payload reused by another instance meanwhile makes it fail
+// on the foreign keys of logs rather than lose the body; it can be rerun.
+func deleteUnusedPayloads(db *DB) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM payloads WHERE hash NOT IN (
+			SELECT request_headers_hash FROM logs WHERE request_headers_hash IS NOT NULL
+			UNION SELECT request_body_hash FROM logs WHERE request_body_hash IS NOT NULL
+			UNION SELECT response_headers_hash FROM logs WHERE response_headers_hash IS NOT NULL
+			UNION SELECT response_body_hash FROM logs WHERE response_body_hash IS NOT NULL
+		)`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// migratePayloads moves headers and bodies stored inline by older versions
+// into the payloads table, then drops the inline columns
+func migratePayloads(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS payloads (
+			hash TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			size INTEGER NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []struct{ name, definition string }{
+		{"request_headers_hash", "TEXT"},
+		{"request_body_hash", "TEXT"},
+		{"request_body_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"response_headers_hash", "TEXT"},
+		{"response_body_hash", "TEXT"},
+		{"response_body_size", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing(tx, "logs", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	inline, err := hasColumn(tx, "logs", "request_body")
+	if err != nil || !inline {
+		return err
+	}
+
+	migrated := 0
+	for {
+		n, err := migratePayloadBatch(tx)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		migrated += n
+		log.Printf("Moved the payloads of %d request(s) to compressed storage", migrated)
+	}
+
+	for _, column := range payloadColumns {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE logs DROP COLUMN %s", column)); err != nil {
+			return fmt.Errorf("dropping %s: %w", column, err)
+		}
+	}
+	if migrated > 0 {
+		log.Printf("Payload migration complete, VACUUM the database to reclaim the space it freed")
+	}
+	return nil
+}
+
+// migratePayloadBatch moves the payloads of the next batch of rows
+func migratePayloadBatch(tx *Tx) (int, error) {
+	rows, err := tx.Query(`
+		SELECT id, request_headers, request_body, response_headers, response_body
+		FROM logs
+		WHERE request_headers != '' OR request_body != '' OR response_headers != '' OR response_body != ''
+		ORDER BY id
+		LIMIT ?`, payloadMigrateBatch)
+	if err != nil {
+		return 0, err
+	}
+	type inlineRow struct {
+		id       int64
+		contents [4]string
+	}
+	var batch []inlineRow
+	for rows.Next() {
+		var row inlineRow
+		if err := rows.Scan(&row.id, &row.contents[0], &row.contents[1], &row.contents[2], &row.contents[3]); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, row := range batch {
+		var hashes [4]any
+		for i, content := range row.contents {
+			if hashes[i], err = storePayload(tx, content); err != nil {
+				return 0, err
+			}
+		}
+		_, err := tx.Exec(`
+			UPDATE logs SET
+				request_headers_hash = ?,
+				request_body_hash = ?,
+				response_headers_hash = ?,
+				response_body_hash = ?,
+				request_body_size = ?,
+				response_body_size = ?,
+				request_headers = '',
+				request_body = '',
+				response_headers = '',
+				response_body = ''
+			WHERE id = ?`,
+			hashes[0], hashes[1], hashes[2], hashes[3], len(row.contents[1]), len(row.contents[3]), row.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), nil
+}
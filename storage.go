@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage keeps the logged requests and what goes with them: annotations,
+// markers, conversations and import hashes. Both databases share sqlStorage:
+// SQLite is the default, and a postgres:// database URL selects PostgreSQL.
+type Storage interface {
+	// ReserveLogIds sets aside ids for new requests, which have their id
+	// before they're written
+	ReserveLogIds() ([]int64, error)
+	// WriteLogs inserts new requests and records responses in one transaction
+	WriteLogs(writes []LogWrite) error
+	// CountLogs counts the requests matching the filter
+	CountLogs(filter LogFilter) (int, error)
+	// ListLogs reads a page of requests matching the filter, newest first,
+	// without headers and bodies
+	ListLogs(filter LogFilter, limit, offset int) ([]LogEntry, error)
+	// GetLog reads a request with its headers and bodies
+	GetLog(id int64) (LogEntry, error)
+	// HasLog reports whether a request exists
+	HasLog(id int64) (bool, error)
+	// SearchLogs calls fn with each request matching the filter, oldest
+	// first, stopping at the first error; exports are built on it
+	SearchLogs(filter LogFilter, fn func(LogEntry) error) error
+	// LogStats sums up the requests matching the filter by provider, model
+	// and the value of metadataKey when set, without reading bodies
+	LogStats(filter LogFilter, metadataKey string) ([]LogStats, error)
+	// MarkInterrupted closes out the requests started before a time that are
+	// still in flight, returning how many there were
+	MarkInterrupted(startedBefore time.Time) (int64, error)
+	// PruneLogs deletes the requests logged before a time, or all but the
+	// keep newest, with the payloads only they used; dryRun only counts them
+	PruneLogs(before time.Time, keep int, dryRun bool) (deleted, payloads int64, err error)
+	// Vacuum reclaims the space of deleted rows
+	Vacuum() error
+	// IndexMetadata indexes the metadata captured from each header
+	IndexMetadata(metadataHeaders []string) error
+
+	// GetAnnotation reads the annotation of a request, empty if there is none
+	GetAnnotation(id int64) (Annotation, error)
+	// SaveAnnotation stores the annotation of a request, removing it once empty
+	SaveAnnotation(annotation Annotation) error
+
+	// CreateMarker records a marker after the latest request, naming an
+	// unnamed one after its id
+	CreateMarker(name, timestamp string) (Marker, error)
+	// MarkerLogSeq finds the place of a marker in write order by its name or
+	// id, a reused name referring to its latest marker; errMarkerNotFound
+	// when there is none
+	MarkerLogSeq(marker string) (int64, error)
+	// ListMarkers lists markers placed after fromLogId, and up to toLogId
+	// when it isn't negative, newest first
+	ListMarkers(fromLogId, toLogId int64) ([]Marker, error)
+	// DeleteMarker removes a marker, reporting whether it existed
+	DeleteMarker(id int64) (bool, error)
+
+	// LatestConversations finds the conversation of the latest request with
+	// each of the messages hashes
+	LatestConversations(messagesHashes []string) (map[string]string, error)
+	// UnthreadedLogs reads up to limit requests logged before conversations
+	// were tracked, with their request headers and body
+	UnthreadedLogs(limit int) ([]LogEntry, error)
+	// SetConversation records the conversation and messages hash of a request
+	SetConversation(entry LogEntry) error
+	// CountConversations counts the conversations with requests matching the filter
+	CountConversations(filter LogFilter) (int, error)
+	// ListConversations reads a page of the conversations with requests
+	// matching the filter, most recently active first
+	ListConversations(filter LogFilter, limit, offset int) ([]ConversationSummary, error)
+
+	// HasLogHash reports whether a request with the content hash exists
+	HasLogHash(hash string) (bool, error)
+
+	Close() error
+}
+
+// sqlStorage is the Storage of a SQLite or PostgreSQL database
+type sqlStorage struct {
+	db *DB
+}
+
+// logEntryColumns are the columns read by scanLogEntry
+var logEntryColumns = `
+	id,
+	timestamp,
+	provider,
+	method,
+	model,
+	target_url,
+	response_status,
+	useragent,
+	duration_ms,
+	state,
+	error,
+	conversation_id,
+	metadata,
+	request_body_size,
+	response_body_size,` + annotationColumns + `,
+	` + payloadColumn("request_headers") + `,
+	` + payloadColumn("request_body") + `,
+	` + payloadColumn("response_headers") + `,
+	` + payloadColumn("response_body")
+
+// scanLogEntry reads a row selected with logEntryColumns
+func scanLogEntry(row interface{ Scan(...any) error }) (entry LogEntry, err error) {
+	var metadata string
+	annotation, decodeAnnotation := scanAnnotation(&entry)
+	payloads, decodePayloads := payloadScan(&entry.RequestHeaders, &entry.RequestBody, &entry.ResponseHeaders, &entry.ResponseBody)
+	err = row.Scan(append(append([]any{
+		&entry.Id,
+		&entry.Timestamp,
+		&entry.Provider,
+		&entry.Method,
+		&entry.Model,
+		&entry.TargetURL,
+		&entry.ResponseStatus,
+		&entry.UserAgent,
+		&entry.DurationMs,
+		&entry.State,
+		&entry.Error,
+		&entry.ConversationId,
+		&metadata,
+		&entry.RequestBodySize,
+		&entry.ResponseBodySize,
+	}, annotation...), payloads...)...)
+	if err == nil {
+		err = decodePayloads()
+	}
+	decodeAnnotation()
+	entry.Metadata = decodeMetadata(metadata)
+	return entry, err
+}
+
+func (st *sqlStorage) ReserveLogIds() ([]int64, error) {
+	// PostgreSQL takes a block from the id sequence. Instances sharing the
+	// database get interleaved ids, which is fine as logs are listed by
+	// timestamp and markers go by seq.
+	if st.db.postgres {
+		rows, err := st.db.Query(`SELECT nextval(pg_get_serial_sequence('logs', 'id')) AS id FROM generate_series(1, ?) ORDER BY id`, logIdBlock)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		ids := make([]int64, 0, logIdBlock)
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, rows.Err()
+	}
+
+	// SQLite reserves a block by moving the AUTOINCREMENT counter past it
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO sqlite_sequence (name, seq)
+		SELECT 'logs', (SELECT COALESCE(MAX(id), 0) FROM logs)
+		WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'logs')`)
+	if err != nil {
+		return nil, err
+	}
+	var last int64
+	if err := tx.QueryRow(`UPDATE sqlite_sequence SET seq = seq + ? WHERE name = 'logs' RETURNING seq`, logIdBlock).Scan(&last); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, logIdBlock)
+	for i := range ids {
+		ids[i] = last - logIdBlock + 1 + int64(i)
+	}
+	return ids, nil
+}
+
+func (st *sqlStorage) WriteLogs(writes []LogWrite) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, write := range writes {
+		switch {
+		case write.Update:
+			// the content of a finished request is final, and hashed for imports
+			if err = updateLog(tx, write.Entry); err == nil {
+				err = storeLogHash(tx, logEntryHash(write.Entry), write.Entry.Id)
+			}
+		case write.ImportHash != "":
+			if err = insertLog(tx, write.Entry); err == nil {
+				err = storeLogHash(tx, write.ImportHash, write.Entry.Id)
+			}
+		default:
+			err = insertLog(tx, write.Entry)
+		}
+		if err != nil {
+			return fmt.Errorf("request %d: %w", write.Entry.Id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// insertLog stores a new request with its reserved id and annotation, next
+// in write order
+func insertLog(db *Tx, entry LogEntry) error {
+	var hashes [4]any
+	for i, content := range []string{entry.RequestHeaders, entry.RequestBody, entry.ResponseHeaders, entry.ResponseBody} {
+		hash, err := storePayload(db, content)
+		if err != nil {
+			return err
+		}
+		hashes[i] = hash
+	}
+
+	promptTokens, completionTokens := logUsage(entry)
+	_, err := db.Exec(`
+		INSERT INTO logs (
+			id,
+			timestamp,
+			provider,
+			method,
+			model,
+			target_url,
+			request_headers_hash,
+			request_body_hash,
+			request_body_size,
+			response_status,
+			response_headers_hash,
+			response_body_hash,
+			response_body_size,
+			useragent,
+			duration_ms,
+			state,
+			error,
+			conversation_id,
+			messages_hash,
+			metadata,
+			prompt_tokens,
+			completion_tokens,
+			seq
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, `+db.db.nextLogSeq()+`)
+		`,
+		entry.Id,
+		entry.Timestamp,
+		entry.Provider,
+		entry.Method,
+		entry.Model,
+		entry.TargetURL,
+		hashes[0],
+		hashes[1],
+		entry.RequestBodySize,
+		entry.ResponseStatus,
+		hashes[2],
+		hashes[3],
+		entry.ResponseBodySize,
+		entry.UserAgent,
+		entry.DurationMs,
+		entry.State,
+		entry.Error,
+		entry.ConversationId,
+		entry.MessagesHash,
+		encodeMetadata(entry.Metadata),
+		promptTokens,
+		completionTokens,
+	)
+	if err != nil || (len(entry.Tags) == 0 && entry.Note == "" && !entry.Starred) {
+		return err
+	}
+	return storeAnnotation(db, Annotation{LogId: entry.Id, Tags: entry.Tags, Note: entry.Note, Starred: entry.Starred})
+}
+
+// updateLog records the response of a request
+func updateLog(db sqlExecer, entry LogEntry) error {
+	headersHash, err := storePayload(db, entry.ResponseHeaders)
+	if err != nil {
+		return err
+	}
+	bodyHash, err := storePayload(db, entry.ResponseBody)
+	if err != nil {
+		return err
+	}
+
+	promptTokens, completionTokens := logUsage(entry)
+	_, err = db.Exec(`
+		UPDATE logs SET
+			response_status = ?,
+			response_headers_hash = ?,
+			response_body_hash = ?,
+			response_body_size = ?,
+			duration_ms = ?,
+			state = ?,
+			error = ?,
+			prompt_tokens = ?,
+			completion_tokens = ?
+		WHERE id = ?`,
+		entry.ResponseStatus,
+		headersHash,
+		bodyHash,
+		entry.ResponseBodySize,
+		entry.DurationMs,
+		entry.State,
+		entry.Error,
+		promptTokens,
+		completionTokens,
+		entry.Id,
+	)
+	return err
+}
+
+func (st *sqlStorage) CountLogs(filter LogFilter) (int, error) {
+	where, args := filter.where(st.db)
+	var count int
+	err := st.db.QueryRow("SELECT COUNT(*) FROM logs "+where, args...).Scan(&count)
+	return count, err
+}
+
+func (st *sqlStorage) ListLogs(filter LogFilter, limit, offset int) ([]LogEntry, error) {
+	where, args := filter.where(st.db)
+	rows, err := st.db.Query(`
+		SELECT
+			id,
+			timestamp,
+			provider,
+			method,
+			model,
+			request_body_size,
+			response_body_size,
+			response_status,
+			useragent,
+			duration_ms,
+			state,
+			error,
+			conversation_id,
+			metadata,`+annotationColumns+`
+		FROM logs
+		`+where+`
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []LogEntry
+	for rows.Next() {
+		var entry LogEntry
+		var metadata string
+		annotation, decodeAnnotation := scanAnnotation(&entry)
+		err := rows.Scan(append([]any{
+			&entry.Id,
+			&entry.Timestamp,
+			&entry.Provider,
+			&entry.Method,
+			&entry.Model,
+			&entry.RequestBodySize,
+			&entry.ResponseBodySize,
+			&entry.ResponseStatus,
+			&entry.UserAgent,
+			&entry.DurationMs,
+			&entry.State,
+			&entry.Error,
+			&entry.ConversationId,
+			&metadata,
+		}, annotation...)...)
+		if err != nil {
+			return nil, err
+		}
+		decodeAnnotation()
+		entry.Metadata = decodeMetadata(metadata)
+		logs = append(logs, entry)
+	}
+	return logs, rows.Err()
+}
+
+func (st *sqlStorage) GetLog(id int64) (LogEntry, error) {
+	return scanLogEntry(st.db.QueryRow(`SELECT `+logEntryColumns+` FROM logs WHERE id = ?`, id))
+}
+
+func (st *sqlStorage) HasLog(id int64) (bool, error) {
+	var exists int
+	err := st.db.QueryRow(`SELECT COUNT(*) FROM logs WHERE id = ?`, id).Scan(&exists)
+	return exists > 0, err
+}
+
+func (st *sqlStorage) SearchLogs(filter LogFilter, fn func(LogEntry) error) error {
+	where, args := filter.where(st.db)
+	rows, err := st.db.Query(`SELECT `+logEntryColumns+` FROM logs `+where+` ORDER BY id ASC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanLogEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (st *sqlStorage) MarkInterrupted(startedBefore time.Time) (int64, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cutoff := startedBefore.UTC().Format(time.RFC3339)
+	result, err := tx.Exec(`
+		UPDATE logs SET state = ?, error = ?
+		WHERE (state = ? OR (state = '' AND response_status < 0)) AND timestamp <= ?`,
+		logStateInterrupted, "llmsee stopped before the request finished", logStateInFlight, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	// the rows are final now, and hashed for imports like finished ones
+	if _, err := hashLogs(tx, "logs.state = ? AND logs.timestamp <= ?", logStateInterrupted, cutoff); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (st *sqlStorage) PruneLogs(before time.Time, keep int, dryRun bool) (deleted, payloads int64, err error) {
+	where := "timestamp < ?"
+	args := []any{before.UTC().Format(time.RFC3339)}
+	if keep > 0 {
+		where = "id NOT IN (SELECT id FROM logs ORDER BY id DESC LIMIT ?)"
+		args = []any{keep}
+	}
+
+	if dryRun {
+		err = st.db.QueryRow("SELECT COUNT(*) FROM logs WHERE "+where, args...).Scan(&deleted)
+		return deleted, 0, err
+	}
+
+	result, err := st.db.Exec("DELETE FROM logs WHERE "+where, args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, _ = result.RowsAffected()
+
+	if _, err := st.db.Exec("DELETE FROM log_hashes WHERE log_id NOT IN (SELECT id FROM logs)"); err != nil {
+		return deleted, 0, err
+	}
+	if _, err := st.db.Exec("DELETE FROM log_annotations WHERE log_id NOT IN (SELECT id FROM logs)"); err != nil {
+		return deleted, 0, err
+	}
+	payloads, err = deleteUnusedPayloads(st.db)
+	return deleted, payloads, err
+}
+
+func (st *sqlStorage) Vacuum() error {
+	_, err := st.db.Exec("VACUUM")
+	return err
+}
+
+func (st *sqlStorage) Close() error {
+	return st.db.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrations are the PostgreSQL counterpart of sqliteMigrations,
+// versioned separately as the first starts at the schema of SQLite version 2
+var postgresMigrations = []migration{
+	{"initial schema", migratePostgresSchema},
+	{"reference payloads with foreign keys", migratePostgresPayloadKeys},
+	{"record token usage for stats", migrateUsage},
+	{"place markers in write order", migrateLogSeq},
+	{"hash finished requests for import deduplication", migrateLogHashes},
+}
+
+// isPostgresURL reports whether a database URL selects PostgreSQL
+func isPostgresURL(database string) bool {
+	return strings.HasPrefix(database, "postgres://") || strings.HasPrefix(database, "postgresql://")
+}
+
+// openPostgres connects to a PostgreSQL database, which several llmsee
+// instances can share
+func openPostgres(databaseURL string) (*DB, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %w", err)
+	}
+	log.Printf("Database %s", u.Redacted())
+
+	sqlDB, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	db := &DB{DB: sqlDB, postgres: true}
+
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	if err := migrateDatabase(db, ""); err != nil {
+		return nil, fmt.Errorf("initializing database: %w", err)
+	}
+
+	return db, nil
+}
+
+// migratePostgresSchema creates the schema of SQLite version 2
+func migratePostgresSchema(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE logs (
+			id BIGSERIAL PRIMARY KEY,
+			timestamp TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			method TEXT NOT NULL,
+			model TEXT NOT NULL,
+			target_url TEXT NOT NULL,
+			request_headers_hash TEXT,
+			request_body_hash TEXT,
+			request_body_size INTEGER NOT NULL DEFAULT 0,
+			response_status INTEGER NOT NULL DEFAULT -1,
+			response_headers_hash TEXT,
+			response_body_hash TEXT,
+			response_body_size INTEGER NOT NULL DEFAULT 0,
+			useragent TEXT NOT NULL DEFAULT '',
+			duration_ms INTEGER NOT NULL DEFAULT -1,
+			state TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			conversation_id TEXT NOT NULL DEFAULT '',
+			messages_hash TEXT,
+			metadata TEXT NOT NULL DEFAULT '{}'
+		);
+
+		CREATE INDEX idx_timestamp ON logs(timestamp);
+		CREATE INDEX idx_conversation_id ON logs(conversation_id);
+		CREATE INDEX idx_messages_hash ON logs(messages_hash);
+
+		CREATE TABLE log_hashes (
+			hash TEXT PRIMARY KEY,
+			log_id BIGINT NOT NULL
+		);
+
+		CREATE TABLE log_annotations (
+			log_id BIGINT PRIMARY KEY,
+			tags TEXT NOT NULL DEFAULT '[]',
+			note TEXT NOT NULL DEFAULT '',
+			starred INTEGER NOT NULL DEFAULT 0,
+			updated TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX idx_annotations_starred ON log_annotations(starred);
+
+		CREATE TABLE markers (
+			id BIGSERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			timestamp TEXT NOT NULL,
+			log_id BIGINT NOT NULL
+		);
+
+		CREATE INDEX idx_markers_name ON markers(name);
+
+		CREATE TABLE payloads (
+			hash TEXT PRIMARY KEY,
+			data BYTEA NOT NULL,
+			size INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// migratePostgresPayloadKeys keeps prune on one instance from deleting a
+// payload another instance is about to refer to. Rows already referring to
+// a missing payload lose the reference, as their content is gone anyway.
+func migratePostgresPayloadKeys(tx *Tx) error {
+	for _, column := range payloadColumns {
+		_, err := tx.Exec(fmt.Sprintf(`
+			UPDATE logs SET %[1]s_hash = NULL
+			WHERE %[1]s_hash = '' OR %[1]s_hash NOT IN (SELECT hash FROM payloads);
+
+			CREATE INDEX idx_%[1]s_hash ON logs(%[1]s_hash);
+			ALTER TABLE logs ADD CONSTRAINT logs_%[1]s_hash_fkey
+				FOREIGN KEY (%[1]s_hash) REFERENCES payloads(hash);
+		`, column))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
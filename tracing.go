@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindClient    = 3
+	spanStatusError   = 2
+	tracerQueueSize   = 2048            // Max spans waiting to be exported
+	tracerBatchSize   = 512             // Max spans per export request
+	tracerBatchPeriod = 5 * time.Second // Export interval for partial batches
+)
+
+// Tracer batches finished spans and exports them to an OTLP/HTTP collector as JSON
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	spans       chan *Span
+	flush       chan chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// Span is a single client span, methods are no-ops on a nil span
+type Span struct {
+	tracer       *Tracer
+	traceId      string
+	spanId       string
+	parentSpanId string
+	traceFlags   string
+	name         string
+	start        time.Time
+	end          time.Time
+	attributes   []otlpAttribute
+	statusCode   int
+	statusMsg    string
+}
+
+type otlpValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	ArrayValue  *otlpValues `json:"arrayValue,omitempty"`
+}
+
+type otlpValues struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// NewTracer starts the export loop, returns nil when tracing isn't configured
+func NewTracer(config *TracingConfig) *Tracer {
+	endpoint := ""
+	if config != nil {
+		endpoint = config.Endpoint
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+
+	t := &Tracer{
+		endpoint:    endpoint,
+		headers:     map[string]string{},
+		serviceName: "llmsee",
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, tracerQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if config != nil {
+		t.serviceName = defaultString(config.ServiceName, t.serviceName)
+		for k, v := range config.Headers {
+			t.headers[k] = v
+		}
+	}
+
+	t.wg.Add(1)
+	go t.run()
+
+	log.Printf("Tracing to %s", endpoint)
+	return t
+}
+
+// StartSpan begins a client span, continuing the trace from an incoming traceparent header
+func (t *Tracer) StartSpan(name string, incoming http.Header) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		spanId:     randomHex(8),
+		traceFlags: "01",
+		name:       name,
+		start:      time.Now(),
+	}
+
+	if traceId, parentId, flags, ok := parseTraceparent(incoming.Get("traceparent")); ok {
+		span.traceId = traceId
+		span.parentSpanId = parentId
+		span.traceFlags = flags
+	} else {
+		span.traceId = randomHex(16)
+	}
+
+	return span
+}
+
+// Inject propagates the span context to the upstream request
+func (span *Span) Inject(headers http.Header) {
+	if span == nil {
+		return
+	}
+	headers.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", span.traceId, span.spanId, span.traceFlags))
+}
+
+// SetAttribute records a string, int, float64, bool or []string attribute
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	var v otlpValue
+	switch val := value.(type) {
+	case string:
+		if val == "" {
+			return
+		}
+		v.StringValue = &val
+	case int:
+		s := strconv.Itoa(val)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &val
+	case bool:
+		v.BoolValue = &val
+	case []string:
+		if len(val) == 0 {
+			return
+		}
+		values := make([]otlpValue, len(val))
+		for i := range val {
+			values[i] = otlpValue{StringValue: &val[i]}
+		}
+		v.ArrayValue = &otlpValues{Values: values}
+	default:
+		return
+	}
+
+	span.attributes = append(span.attributes, otlpAttribute{Key: key, Value: v})
+}
+
+// SetError marks the span as failed
+func (span *Span) SetError(errorType, message string) {
+	if span == nil {
+		return
+	}
+	span.statusCode = spanStatusError
+	span.statusMsg = message
+	span.SetAttribute("error.type", errorType)
+}
+
+// End finishes the span and queues it for export
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.end = time.Now()
+
+	select {
+	case span.tracer.spans <- span:
+	default:
+		log.Printf("Warning: trace export queue full, dropping span")
+	}
+}
+
+// Shutdown exports any queued spans and stops the export loop
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+
+	close(t.done)
+	t.wg.Wait()
+}
+
+// run collects spans into batches and exports them
+func (t *Tracer) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(tracerBatchPeriod)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil {
+				log.Printf("failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= tracerBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			export()
+			close(flushed)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// export sends a batch of spans as an OTLP/HTTP JSON request
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = otlpSpan{
+			TraceId:           span.traceId,
+			SpanId:            span.spanId,
+			ParentSpanId:      span.parentSpanId,
+			Name:              span.name,
+			Kind:              spanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        span.attributes,
+			Status:            otlpStatus{Code: span.statusCode, Message: span.statusMsg},
+		}
+	}
+
+	serviceName := t.serviceName
+	scopeVersion := VERSION
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						{Key: "service.name", Value: otlpValue{StringValue: &serviceName}},
+						{Key: "service.version", Value: otlpValue{StringValue: &scopeVersion}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "llmsee", "version": VERSION},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent validates a W3C traceparent header
+func parseTraceparent(header string) (traceId, parentId, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", "", false
+	}
+	traceId, parentId, flags = strings.ToLower(parts[1]), strings.ToLower(parts[2]), strings.ToLower(parts[3])
+	if len(traceId) != 32 || len(parentId) != 16 || len(flags) != 2 {
+		return "", "", "", false
+	}
+	if !isHex(traceId) || !isHex(parentId) || !isHex(flags) {
+		return "", "", "", false
+	}
+	if strings.Trim(traceId, "0") == "" || strings.Trim(parentId, "0") == "" {
+		return "", "", "", false
+	}
+	return traceId, parentId, flags, true
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// genAIOperation maps the proxied path onto a gen_ai.operation.name
+func genAIOperation(path string) string {
+	switch {
+	case strings.HasSuffix(path, "chat/completions"):
+		return "chat"
+	case strings.HasSuffix(path, "embeddings"):
+		return "embeddings"
+	case strings.HasSuffix(path, "completions"):
+		return "text_completion"
+	default:
+		return path
+	}
+}
+
+// genAISystems maps the hosts of well-known APIs onto their gen_ai.system
+var genAISystems = map[string]string{
+	"api.openai.com":                    "openai",
+	"api.anthropic.com":                 "anthropic",
+	"generativelanguage.googleapis.com": "gcp.gemini",
+	"api.mistral.ai":                    "mistral_ai",
+	"api.cohere.com":                    "cohere",
+	"api.cohere.ai":                     "cohere",
+	"api.groq.com":                      "groq",
+	"api.deepseek.com":                  "deepseek",
+	"api.perplexity.ai":                 "perplexity",
+	"api.x.ai":                          "xai",
+}
+
+// genAISystem is the gen_ai.system of an upstream host, _OTHER when it isn't
+// a well-known API
+func genAISystem(host string) string {
+	if system, ok := genAISystems[host]; ok {
+		return system
+	}
+	switch {
+	case strings.HasSuffix(host, ".openai.azure.com"):
+		return "az.ai.openai"
+	case strings.HasPrefix(host, "bedrock-runtime.") && strings.HasSuffix(host, ".amazonaws.com"):
+		return "aws.bedrock"
+	case strings.HasSuffix(host, "-aiplatform.googleapis.com"):
+		return "gcp.vertex_ai"
+	}
+	return "_OTHER"
+}
+
+// startProxySpan starts the span for a proxied call with the GenAI request attributes
+func (s *ProxyServer) startProxySpan(r *http.Request, provider, model, remainingPath, targetURL string, bodyJSON map[string]interface{}) *Span {
+	operation := genAIOperation(remainingPath)
+	span := s.tracer.StartSpan(strings.TrimSpace(operation+" "+model), r.Header)
+	if span == nil {
+		return nil
+	}
+
+	span.SetAttribute("gen_ai.operation.name", operation)
+	span.SetAttribute("llmsee.provider", provider)
+	span.SetAttribute("gen_ai.request.model", model)
+	span.SetAttribute("http.request.method", r.Method)
+	if u, err := url.Parse(targetURL); err == nil {
+		span.SetAttribute("gen_ai.system", genAISystem(u.Hostname()))
+		// the query may hold an API key, as with Gemini
+		redacted := *u
+		redacted.User, redacted.RawQuery, redacted.Fragment = nil, "", ""
+		span.SetAttribute("url.full", redacted.String())
+		span.SetAttribute("server.address", u.Hostname())
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			span.SetAttribute("server.port", p)
+		}
+	}
+
+	for param, attr := range map[string]string{
+		"temperature":       "gen_ai.request.temperature",
+		"top_p":             "gen_ai.request.top_p",
+		"frequency_penalty": "gen_ai.request.frequency_penalty",
+		"presence_penalty":  "gen_ai.request.presence_penalty",
+	} {
+		if v, ok := bodyJSON[param].(float64); ok {
+			span.SetAttribute(attr, v)
+		}
+	}
+	for _, param := range []string{"max_tokens", "max_completion_tokens"} {
+		if v, ok := bodyJSON[param].(float64); ok {
+			span.SetAttribute("gen_ai.request.max_tokens", int(v))
+			break
+		}
+	}
+
+	return span
+}
+
+// endProxySpan records the GenAI response attributes from the logged entry and ends the span
+func endProxySpan(span *Span, entry LogEntry) {
+	if span == nil {
+		return
+	}
+
+	if entry.ResponseStatus > 0 {
+		span.SetAttribute("http.response.status_code", entry.ResponseStatus)
+	}
+	if entry.ResponseStatus >= 400 {
+		span.SetError(strconv.Itoa(entry.ResponseStatus), http.StatusText(entry.ResponseStatus))
+	}
+	if entry.State != logStateCompleted {
+		span.SetAttribute("llmsee.state", entry.State)
+		span.SetError(entry.State, entry.Error)
+	}
+
+	if response, ok := parseChatResponse(entry.ResponseBody); ok {
+		span.SetAttribute("gen_ai.response.id", response.Id)
+		span.SetAttribute("gen_ai.response.model", response.Model)
+		if response.FinishReason != "" {
+			span.SetAttribute("gen_ai.response.finish_reasons", []string{response.FinishReason})
+		}
+		if response.Usage != nil {
+			span.SetAttribute("gen_ai.usage.input_tokens", response.Usage.PromptTokens)
+			span.SetAttribute("gen_ai.usage.output_tokens", response.Usage.CompletionTokens)
+		}
+	}
+
+	span.End()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 256             // Max deliveries waiting to be sent
+	webhookWorkers     = 4               // Concurrent deliveries
+	webhookMaxAttempts = 4               // Attempts per delivery before giving up
+	webhookBackoff     = 1 * time.Second // Initial retry delay, doubled per attempt
+	webhookTimeout     = 10 * time.Second
+)
+
+// Notifier delivers matching log events to the configured webhooks
+type Notifier struct {
+	client     *http.Client
+	deliveries chan webhookDelivery
+	stopping   chan struct{} // closed by Shutdown; deliveries stays open for late Notify calls
+	ctx        context.Context
+	cancel     context.CancelFunc // abandons deliveries in progress
+	wg         sync.WaitGroup
+}
+
+// errWebhookRejected is returned for a delivery the webhook refused, which
+// isn't retried
+var errWebhookRejected = errors.New("webhook rejected the delivery")
+
+type webhookDelivery struct {
+	url    string
+	secret string
+	body   []byte
+}
+
+// WebhookPayload is the body posted to a webhook
+type WebhookPayload struct {
+	ServerUpdate
+	Reasons []string `json:"reasons"`
+	Cost    *float64 `json:"cost,omitempty"`
+	Text    string   `json:"text"`
+}
+
+// NewNotifier starts the delivery workers
+func NewNotifier() *Notifier {
+	n := &Notifier{
+		client:     &http.Client{Timeout: webhookTimeout},
+		deliveries: make(chan webhookDelivery, webhookQueueSize),
+		stopping:   make(chan struct{}),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	for range webhookWorkers {
+		n.wg.Add(1)
+		go n.run()
+	}
+
+	return n
+}
+
+// Notify queues a delivery for each webhook whose conditions match the completed entry
+func (n *Notifier) Notify(update ServerUpdate, webhooks []WebhookConfig, providerConfig ProviderConfig) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	entry := update.Entry
+
+	var cost *float64
+	if response, ok := parseChatResponse(entry.ResponseBody); ok {
+		if c, ok := providerConfig.Cost(entry.Model, response.Usage); ok {
+			cost = &c
+		}
+	}
+
+	// never forward credentials or payloads
+	update.Entry.RequestHeaders = ""
+	update.Entry.RequestBody = ""
+	update.Entry.ResponseHeaders = ""
+	update.Entry.ResponseBody = ""
+
+	for _, webhook := range webhooks {
+		reasons, ok := webhook.match(entry, cost)
+		if !ok {
+			continue
+		}
+
+		outcome := fmt.Sprintf("returned %d", entry.ResponseStatus)
+		if entry.State != logStateCompleted {
+			outcome = "ended " + entry.State
+		}
+
+		payload := WebhookPayload{
+			ServerUpdate: update,
+			Reasons:      reasons,
+			Cost:         cost,
+			Text: fmt.Sprintf("[llmsee] #%d %s %s %s %s in %dms (%s)",
+				entry.Id, entry.Provider, entry.Model, entry.Method, outcome, entry.DurationMs, strings.Join(reasons, ", ")),
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("failed to encode webhook payload: %v", err)
+			continue
+		}
+
+		select {
+		case <-n.stopping:
+			log.Printf("Warning: shutting down, dropping notification for %s", webhook.URL)
+			continue
+		default:
+		}
+		select {
+		case n.deliveries <- webhookDelivery{url: webhook.URL, secret: webhook.Secret, body: body}:
+		default:
+			log.Printf("Warning: webhook queue full, dropping notification for %s", webhook.URL)
+		}
+	}
+}
+
+// match reports whether the entry meets every condition set on the webhook.
+// A request that didn't complete meets any minstatus, as it has no status of
+// its own while the client got an error.
+func (webhook WebhookConfig) match(entry LogEntry, cost *float64) (reasons []string, ok bool) {
+	if webhook.MinStatus > 0 {
+		switch {
+		case entry.State != logStateCompleted:
+			reasons = append(reasons, "ended "+entry.State)
+		case entry.ResponseStatus >= webhook.MinStatus:
+			reasons = append(reasons, fmt.Sprintf("status %d >= %d", entry.ResponseStatus, webhook.MinStatus))
+		default:
+			return nil, false
+		}
+	}
+
+	if webhook.MinDurationMs > 0 {
+		if entry.DurationMs <= webhook.MinDurationMs {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("duration %dms > %dms", entry.DurationMs, webhook.MinDurationMs))
+	}
+
+	if len(webhook.Models) > 0 {
+		if !slices.Contains(webhook.Models, entry.Model) {
+			return nil, false
+		}
+		reasons = append(reasons, "model "+entry.Model)
+	}
+
+	if webhook.MinCost > 0 {
+		if cost == nil || *cost < webhook.MinCost {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("cost $%.4f >= $%.4f", *cost, webhook.MinCost))
+	}
+
+	if len(reasons) == 0 {
+		reasons = append(reasons, "all requests")
+	}
+
+	return reasons, true
+}
+
+// Shutdown waits for queued deliveries, abandoning them, including those in
+// progress, once the context expires
+func (n *Notifier) Shutdown(ctx context.Context) {
+	close(n.stopping)
+	stopped := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+	n.cancel()
+}
+
+// run sends queued deliveries until shutdown, then sends what's left in the queue
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case delivery := <-n.deliveries:
+			n.deliver(delivery)
+		case <-n.stopping:
+			for {
+				select {
+				case delivery := <-n.deliveries:
+					n.deliver(delivery)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts the payload, retrying failures with exponential backoff
+func (n *Notifier) deliver(delivery webhookDelivery) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(n.ctx, delivery)
+		if err == nil || n.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errWebhookRejected) {
+			log.Printf("failed to deliver webhook to %s: %v", delivery.url, err)
+			return
+		}
+		if attempt >= webhookMaxAttempts {
+			log.Printf("failed to deliver webhook to %s after %d attempts: %v", delivery.url, attempt, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// post sends one signed delivery attempt
+func (n *Notifier) post(ctx context.Context, delivery webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "llmsee/"+VERSION)
+	if delivery.secret != "" {
+		mac := hmac.New(sha256.New, []byte(delivery.secret))
+		mac.Write(delivery.body)
+		req.Header.Set("X-Llmsee-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// the webhook won't take the same delivery later, unless it asked to slow down
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %s", errWebhookRejected, resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}